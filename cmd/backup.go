@@ -0,0 +1,587 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// BackupFileInfo is a file, directory or symlink saved before zetup replaced
+// it, the contents of files are kept in $ZETUP_DIR/.bak/objects by sha256
+type BackupFileInfo struct {
+	Location string `yaml:"location"`
+	// file, dir or symlink
+	Type string `yaml:"type,omitempty"`
+	// permission bits in octal, like 0600
+	Mode       string `yaml:"mode,omitempty"`
+	UID        int    `yaml:"uid"`
+	GID        int    `yaml:"gid"`
+	LinkTarget string `yaml:"link-target,omitempty"`
+	Hash       string `yaml:"hash,omitempty"`
+	// Contents is only set in backups made by older versions of zetup,
+	// which saved files as text
+	Contents string `yaml:"contents,omitempty"`
+}
+
+func backupObjectsDir() string {
+	return path.Join(bakDir, "objects")
+}
+
+// backupLocation saves location, and everything in it if it is a directory,
+// symlinks are saved as symlinks and not followed
+func backupLocation(location string) ([]BackupFileInfo, error) {
+	var entries []BackupFileInfo
+	err := filepath.Walk(location, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entry := BackupFileInfo{
+			Location: file,
+			Mode:     fmt.Sprintf("%#o", info.Mode().Perm()),
+		}
+		entry.UID, entry.GID = fileOwner(info)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Type = "symlink"
+			entry.LinkTarget, err = os.Readlink(file)
+		case info.IsDir():
+			entry.Type = "dir"
+		case info.Mode().IsRegular():
+			entry.Type = "file"
+			entry.Hash, err = storeBackupObject(file)
+		default:
+			err = fmt.Errorf("can not back up %v, it is not a file, directory or symlink", file)
+		}
+		entries = append(entries, entry)
+		return err
+	})
+	return entries, err
+}
+
+// storeBackupObject copies file into the object store, named by its sha256
+func storeBackupObject(file string) (string, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(dat))
+	object := path.Join(backupObjectsDir(), hash)
+	if _, err := os.Stat(object); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(backupObjectsDir(), 0700); err != nil {
+		return "", err
+	}
+	// objects can be private files like ssh configs, the mode is in the entry
+	tmp := object + ".tmp"
+	if err := ioutil.WriteFile(tmp, dat, 0600); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp, object)
+}
+
+// BackupGeneration is one set of backups taken by LinkFiles, the latest one of
+// every scope is what unuse restores, older ones are kept in
+// $ZETUP_DIR/.bak/generations until they are pruned
+type BackupGeneration struct {
+	// ID counts up from 1 in the order generations were taken
+	ID      int              `yaml:"id"`
+	Created time.Time        `yaml:"created"`
+	Scope   string           `yaml:"scope"`
+	Pkg     string           `yaml:"pkg,omitempty"`
+	Commit  string           `yaml:"commit,omitempty"`
+	Files   []BackupFileInfo `yaml:"files"`
+}
+
+func backupGenerationsDir() string {
+	return path.Join(bakDir, "generations")
+}
+
+// saveBackup records files as the backup of scope and as a new generation
+func saveBackup(scope string, files []BackupFileInfo) error {
+	return saveBackupGeneration(BackupGeneration{
+		Created: time.Now(),
+		Scope:   scope,
+		Pkg:     pkgKey(usePkgDir),
+		Commit:  headCommit(usePkgDir),
+		Files:   files,
+	})
+}
+
+// saveBackupGeneration numbers gen and writes it as a generation and as the
+// backup of its scope, a scope with nothing to back up gets neither
+func saveBackupGeneration(gen BackupGeneration) error {
+	if len(gen.Files) == 0 {
+		return nil
+	}
+	gens, err := listBackupGenerations()
+	if err != nil {
+		return err
+	}
+	gen.ID = 1
+	if len(gens) > 0 {
+		gen.ID = gens[len(gens)-1].ID + 1
+	}
+	if err := os.MkdirAll(backupGenerationsDir(), 0700); err != nil {
+		return err
+	}
+	genFile := path.Join(backupGenerationsDir(), strconv.Itoa(gen.ID)+".yml")
+	if err := writeBackupGeneration(genFile, gen); err != nil {
+		return err
+	}
+	scopeFile := backupScopeFile(gen.Scope)
+	if err := os.MkdirAll(path.Dir(scopeFile), 0700); err != nil {
+		return err
+	}
+	return writeBackupGeneration(scopeFile, gen)
+}
+
+func backupScopesDir() string {
+	return path.Join(bakDir, "scopes")
+}
+
+// backupScope names the backups of the package in use, or of one of its
+// subpackages, like github.com/user/pkg/subpkg/vim
+func backupScope(subpkg string) string {
+	if subpkg == "" {
+		return pkgKey(usePkgDir) + "/main"
+	}
+	return pkgKey(usePkgDir) + "/subpkg/" + subpkg
+}
+
+// backupScopeFile holds what zetup displaced in scope, until it is restored
+func backupScopeFile(scope string) string {
+	return path.Join(backupScopesDir(), scope+".yml")
+}
+
+// listBackupScopes maps every scope with a backup to its file
+func listBackupScopes() (map[string]string, error) {
+	if err := migrateLegacyBackups(); err != nil {
+		return nil, err
+	}
+	scopes := map[string]string{}
+	err := filepath.Walk(backupScopesDir(), func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() || !strings.HasSuffix(file, ".yml") {
+			return err
+		}
+		rel, _ := filepath.Rel(backupScopesDir(), file)
+		scopes[strings.TrimSuffix(filepath.ToSlash(rel), ".yml")] = file
+		return nil
+	})
+	return scopes, err
+}
+
+// LinkSnapshot is how the targets of a scope, and everything its backups
+// would restore, were before LinkFiles changed them
+type LinkSnapshot struct {
+	Files []BackupFileInfo `yaml:"files,omitempty"`
+	// Absent locations did not exist
+	Absent []string `yaml:"absent,omitempty"`
+	// Backups are the backup files of the scope with their contents
+	Backups map[string]string `yaml:"backups,omitempty"`
+}
+
+// snapshotLinks saves the targets of toLinkFiles and the locations in the
+// backups of scope as they are now, the contents of files go to the object
+// store like backups
+func snapshotLinks(scope string, toLinkFiles []ToLink) (LinkSnapshot, error) {
+	snapshot := LinkSnapshot{Backups: map[string]string{}}
+	var locations []string
+	for _, toLinkFile := range toLinkFiles {
+		locations = append(locations, toLinkFile.Target)
+	}
+	if err := migrateLegacyBackups(); err != nil {
+		return snapshot, err
+	}
+	scopeFile := backupScopeFile(scope)
+	dat, err := ioutil.ReadFile(scopeFile)
+	if err == nil {
+		snapshot.Backups[scopeFile] = string(dat)
+		gen, err := readBackupGeneration(scopeFile)
+		if err != nil {
+			return snapshot, err
+		}
+		for _, entry := range gen.Files {
+			locations = append(locations, entry.Location)
+		}
+	} else if !os.IsNotExist(err) {
+		return snapshot, err
+	}
+
+	// a directory is saved with everything in it
+	sort.Strings(locations)
+	var saved []string
+	for _, location := range locations {
+		inSaved := false
+		for _, savedLocation := range saved {
+			if location == savedLocation || strings.HasPrefix(location, savedLocation+string(filepath.Separator)) {
+				inSaved = true
+			}
+		}
+		if inSaved {
+			continue
+		}
+		saved = append(saved, location)
+		if _, err := os.Lstat(location); os.IsNotExist(err) {
+			snapshot.Absent = append(snapshot.Absent, location)
+			continue
+		}
+		entries, err := backupLocation(location)
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.Files = append(snapshot.Files, entries...)
+	}
+	return snapshot, nil
+}
+
+// restoreLinkSnapshot puts the locations and the backups of scope back the
+// way snapshotLinks found them
+func restoreLinkSnapshot(scope string, snapshot LinkSnapshot) error {
+	for _, location := range snapshot.Absent {
+		if err := os.RemoveAll(location); err != nil {
+			return err
+		}
+	}
+	if err := restoreBackupEntries(snapshot.Files); err != nil {
+		return err
+	}
+
+	scopeFile := backupScopeFile(scope)
+	if _, ok := snapshot.Backups[scopeFile]; !ok {
+		if err := os.Remove(scopeFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for file, contents := range snapshot.Backups {
+		if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyBackupsMigrated is set once migrateLegacyBackups ran
+var legacyBackupsMigrated bool
+
+// migrateLegacyBackups moves the backups older versions of zetup kept directly
+// in bakDir, main-backup.bak and <subpkg>.sub.bak, to the scopes of the
+// package in use and removes them, they are then restored once like any other
+// backup. They hold what was there before zetup, so they win over a backup of
+// the same location taken since, which can only be zetup's own link.
+func migrateLegacyBackups() error {
+	if legacyBackupsMigrated {
+		return nil
+	}
+	legacyBackupsMigrated = true
+	files, err := ioutil.ReadDir(bakDir)
+	if err != nil {
+		return err
+	}
+	pkg := "legacy"
+	if mainViper.GetString("use-pkg") != "" {
+		pkg = pkgKey(mainViper.GetString("use-pkg"))
+	}
+	for _, file := range files {
+		var scope string
+		switch {
+		case file.IsDir():
+			continue
+		case file.Name() == "main-backup.bak":
+			scope = pkg + "/main"
+		case strings.HasSuffix(file.Name(), ".sub.bak"):
+			scope = pkg + "/subpkg/" + strings.TrimSuffix(file.Name(), ".sub.bak")
+		default:
+			continue
+		}
+		legacyFile := path.Join(bakDir, file.Name())
+		legacy, err := readBackupGeneration(legacyFile)
+		if err != nil {
+			return err
+		}
+		if len(legacy.Files) > 0 {
+			gen := BackupGeneration{Created: file.ModTime(), Scope: scope, Pkg: pkg, Files: legacy.Files}
+			if current, err := readBackupGeneration(backupScopeFile(scope)); err == nil {
+				gen.Files = append(gen.Files, backupEntriesOutside(current.Files, legacy.Files)...)
+			}
+			if err := saveBackupGeneration(gen); err != nil {
+				return err
+			}
+			log.Printf("moved the backups in %v to %v\n", legacyFile, scope)
+		}
+		if err := os.Remove(legacyFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupEntriesOutside are the entries not at or inside a location of others
+func backupEntriesOutside(entries []BackupFileInfo, others []BackupFileInfo) []BackupFileInfo {
+	var outside []BackupFileInfo
+	for _, entry := range entries {
+		inside := false
+		for _, other := range others {
+			if entry.Location == other.Location || strings.HasPrefix(entry.Location, other.Location+string(filepath.Separator)) {
+				inside = true
+			}
+		}
+		if !inside {
+			outside = append(outside, entry)
+		}
+	}
+	return outside
+}
+
+// restoreBackupScope restores the backups of scope, they are removed once
+// restored and kept only as generations. Scopes of subpackages are restored
+// on their own, a scope never includes others.
+func restoreBackupScope(scope string) error {
+	if err := migrateLegacyBackups(); err != nil {
+		return err
+	}
+	scopeFile := backupScopeFile(scope)
+	if _, err := os.Stat(scopeFile); os.IsNotExist(err) {
+		return nil
+	}
+	if err := restoreBackupFile(scopeFile); err != nil {
+		return err
+	}
+	return os.Remove(scopeFile)
+}
+
+func writeBackupGeneration(file string, gen BackupGeneration) error {
+	marshaled, err := yaml.Marshal(gen)
+	if err != nil {
+		return err
+	}
+	backupWithHeader := []byte("# generated file do not edit\n" + string(marshaled))
+	return ioutil.WriteFile(file, backupWithHeader, 0600)
+}
+
+// readBackupGeneration also reads backups made by older versions of zetup,
+// which were only a list of files
+func readBackupGeneration(file string) (BackupGeneration, error) {
+	var gen BackupGeneration
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return gen, err
+	}
+	if err := yaml.Unmarshal(dat, &gen); err != nil {
+		gen = BackupGeneration{Scope: path.Base(file)}
+		err = yaml.Unmarshal(dat, &gen.Files)
+		return gen, err
+	}
+	return gen, nil
+}
+
+// listBackupGenerations returns every generation, oldest first
+func listBackupGenerations() ([]BackupGeneration, error) {
+	files, err := ioutil.ReadDir(backupGenerationsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var gens []BackupGeneration
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".yml") {
+			continue
+		}
+		gen, err := readBackupGeneration(path.Join(backupGenerationsDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool {
+		return gens[i].ID < gens[j].ID
+	})
+	return gens, nil
+}
+
+func findBackupGeneration(id string) (BackupGeneration, error) {
+	genFile := path.Join(backupGenerationsDir(), strings.TrimSuffix(id, ".yml")+".yml")
+	gen, err := readBackupGeneration(genFile)
+	if os.IsNotExist(err) {
+		return gen, fmt.Errorf("no backup generation %v, see `zetup backups list`", id)
+	}
+	return gen, err
+}
+
+// pruneBackupGenerations keeps the newest keep generations of every scope and
+// removes objects no backup refers to anymore
+func pruneBackupGenerations(keep int) ([]BackupGeneration, error) {
+	gens, err := listBackupGenerations()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []BackupGeneration
+	kept := map[string]int{}
+	for i := len(gens) - 1; i >= 0; i-- {
+		kept[gens[i].Scope]++
+		if kept[gens[i].Scope] <= keep {
+			continue
+		}
+		err := os.Remove(path.Join(backupGenerationsDir(), strconv.Itoa(gens[i].ID)+".yml"))
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, gens[i])
+	}
+	return pruned, removeUnusedBackupObjects()
+}
+
+func removeUnusedBackupObjects() error {
+	used := map[string]bool{}
+	gens, err := listBackupGenerations()
+	if err != nil {
+		return err
+	}
+	scopes, err := listBackupScopes()
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, scopeFile := range scopes {
+		files = append(files, scopeFile)
+	}
+	for _, file := range files {
+		gen, err := readBackupGeneration(file)
+		if err != nil {
+			return err
+		}
+		gens = append(gens, gen)
+	}
+	for _, gen := range gens {
+		for _, entry := range gen.Files {
+			used[entry.Hash] = true
+		}
+	}
+	// a rollback still needs the snapshots of an unfinished run
+	if j, err := readJournal(); err == nil {
+		for _, journalEntry := range j.Entries {
+			if journalEntry.Snapshot != nil {
+				for _, entry := range journalEntry.Snapshot.Files {
+					used[entry.Hash] = true
+				}
+			}
+		}
+	}
+
+	objects, err := ioutil.ReadDir(backupObjectsDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if !used[object.Name()] {
+			if err := os.Remove(path.Join(backupObjectsDir(), object.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restore backups of linked files
+func restoreBackupFile(bakupFile string) error {
+	gen, err := readBackupGeneration(bakupFile)
+	if err != nil {
+		return err
+	}
+	return restoreBackupEntries(gen.Files)
+}
+
+// restoreBackupEntries puts every entry back exactly as it was, whatever is
+// at a location now is replaced, entries inside a directory follow it
+func restoreBackupEntries(entries []BackupFileInfo) error {
+	var dirs []BackupFileInfo
+	top := ""
+	for _, entry := range entries {
+		if top == "" || !strings.HasPrefix(entry.Location, top+string(filepath.Separator)) {
+			top = entry.Location
+			if err := os.RemoveAll(entry.Location); err != nil {
+				return err
+			}
+		}
+
+		mode := os.FileMode(0644)
+		if parsed, err := strconv.ParseUint(entry.Mode, 0, 32); err == nil {
+			mode = os.FileMode(parsed)
+		}
+		var err error
+		switch entry.Type {
+		case "dir":
+			err = os.Mkdir(entry.Location, 0700)
+			// set the real mode once everything in it is restored
+			dirs = append(dirs, entry)
+		case "symlink":
+			err = os.Symlink(entry.LinkTarget, entry.Location)
+		case "file":
+			var dat []byte
+			dat, err = ioutil.ReadFile(path.Join(backupObjectsDir(), entry.Hash))
+			if err == nil {
+				err = ioutil.WriteFile(entry.Location, dat, mode)
+			}
+			if err == nil {
+				err = os.Chmod(entry.Location, mode)
+			}
+		case "":
+			err = ioutil.WriteFile(entry.Location, []byte(entry.Contents), 0644)
+		default:
+			err = fmt.Errorf("unknown backup type %v", entry.Type)
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Type != "" {
+			restoreOwner(entry)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		mode, err := strconv.ParseUint(dirs[i].Mode, 0, 32)
+		if err != nil {
+			continue
+		}
+		if err := os.Chmod(dirs[i].Location, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// files owned by someone else can only be given back when zetup may chown
+func restoreOwner(entry BackupFileInfo) {
+	info, err := os.Lstat(entry.Location)
+	if err != nil {
+		return
+	}
+	uid, gid := fileOwner(info)
+	if uid == entry.UID && gid == entry.GID {
+		return
+	}
+	if err := os.Lchown(entry.Location, entry.UID, entry.GID); err != nil {
+		log.Printf("could not restore the owner of %v: %v\n", entry.Location, err)
+	}
+}
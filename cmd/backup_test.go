@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// withTestZetupDir points zetup at a fresh $ZETUP_DIR with an empty config
+// and github.com/me/dotfiles as the package in use, the returned func puts
+// everything back
+func withTestZetupDir(t *testing.T) (string, func()) {
+	oldViper, oldZetupDir, oldBakDir, oldRcDir := mainViper, zetupDir, bakDir, rcDir
+	oldPkgDir, oldUsePkgDir, oldJournal := pkgDir, usePkgDir, journal
+	dir, err := ioutil.TempDir("", "zetup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zetupDir = dir
+	bakDir = path.Join(dir, ".bak")
+	rcDir = path.Join(dir, "rc")
+	pkgDir = path.Join(dir, "pkg")
+	usePkgDir = path.Join(pkgDir, "github.com/me/dotfiles")
+	for _, d := range []string{bakDir, rcDir, usePkgDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configFile := path.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte("github-username: me\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainViper = viper.New()
+	mainViper.SetConfigFile(configFile)
+	if err := mainViper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	legacyBackupsMigrated = false
+	journal = nil
+
+	return dir, func() {
+		mainViper, zetupDir, bakDir, rcDir = oldViper, oldZetupDir, oldBakDir, oldRcDir
+		pkgDir, usePkgDir, journal = oldPkgDir, oldUsePkgDir, oldJournal
+		os.RemoveAll(dir)
+	}
+}
+
+// describeTree lists everything at and under root with its type, mode and
+// contents or link target
+func describeTree(t *testing.T, root string) []string {
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return []string{"absent"}
+	}
+	var tree []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, file)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			dest, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			tree = append(tree, fmt.Sprintf("%v symlink %v", rel, dest))
+		case info.IsDir():
+			tree = append(tree, fmt.Sprintf("%v dir %#o", rel, info.Mode().Perm()))
+		default:
+			dat, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			tree = append(tree, fmt.Sprintf("%v file %#o %q", rel, info.Mode().Perm(), dat))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	dir, cleanup := withTestZetupDir(t)
+	defer cleanup()
+
+	// files are made with their mode set afterwards, so the umask doesn't
+	// change them
+	write := func(file string, contents string, mode os.FileMode) {
+		if err := ioutil.WriteFile(file, []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(file, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir := func(d string, mode os.FileMode) {
+		if err := os.Mkdir(d, mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(d, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := path.Join(dir, "bashrc")
+	write(file, "export EDITOR=vim\n", 0600)
+
+	script := path.Join(dir, "run.sh")
+	write(script, "#!/bin/sh\necho hi\n", 0755)
+
+	link := path.Join(dir, "vimrc")
+	if err := os.Symlink("/somewhere/else/vimrc", link); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := path.Join(dir, "config")
+	mkdir(tree, 0750)
+	write(path.Join(tree, "a"), "same", 0644)
+	write(path.Join(tree, "b"), "same", 0640)
+	mkdir(path.Join(tree, "private"), 0700)
+	write(path.Join(tree, "private", "key"), "secret", 0400)
+	if err := os.Symlink("a", path.Join(tree, "link-to-a")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, location := range []string{file, script, link, tree} {
+		before := describeTree(t, location)
+		entries, err := backupLocation(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// whatever zetup put there is replaced
+		if err := os.RemoveAll(location); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(path.Join(usePkgDir, "x"), location); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restoreBackupEntries(entries); err != nil {
+			t.Fatalf("restoring %v: %v", location, err)
+		}
+		if after := describeTree(t, location); !reflect.DeepEqual(before, after) {
+			t.Errorf("%v was\n%q\nbut is restored as\n%q", location, before, after)
+		}
+	}
+
+	// files with the same contents share an object
+	objects, err := ioutil.ReadDir(backupObjectsDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 4 {
+		t.Errorf("the object store has %v objects, want 4", len(objects))
+	}
+}
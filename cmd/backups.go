@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var backupsKeep int
+
+// backupsCmd represents the backups command
+var backupsCmd = &cobra.Command{
+	Use:   "backups",
+	Short: "list and restore backups of files zetup replaced",
+	Long: `Every time zetup links files it first backs up whatever was at the
+targets. Each of those backups is kept as a numbered generation, along with
+the package and commit that replaced the files, in $ZETUP_DIR/.bak.`,
+}
+
+var backupsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list backup generations, oldest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		gens, err := listBackupGenerations()
+		check(err)
+		if len(gens) == 0 {
+			fmt.Println("no backups")
+			return
+		}
+		for _, gen := range gens {
+			fmt.Printf("%-4v %v  %-20v %v %.7v (%v files)\n", gen.ID,
+				gen.Created.Format("2006-01-02 15:04:05"), gen.Scope, gen.Pkg,
+				gen.Commit, len(gen.Files))
+		}
+	},
+}
+
+var backupsShowCmd = &cobra.Command{
+	Use:   "show <gen>",
+	Short: "show the files in a backup generation",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		gen, err := findBackupGeneration(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("generation %v, %v\n", gen.ID, gen.Created.Format("2006-01-02 15:04:05"))
+		fmt.Printf("scope %v of %v at %v\n\n", gen.Scope, gen.Pkg, gen.Commit)
+		for _, entry := range gen.Files {
+			line := fmt.Sprintf("%-7v %v %v:%v %v", entry.Type, entry.Mode, entry.UID, entry.GID, entry.Location)
+			switch entry.Type {
+			case "symlink":
+				line += " -> " + entry.LinkTarget
+			case "file":
+				line += fmt.Sprintf(" (%.12v)", entry.Hash)
+			}
+			fmt.Println(line)
+		}
+	},
+}
+
+var backupsRestoreCmd = &cobra.Command{
+	Use:   "restore <gen> [path...]",
+	Short: "put back the files of a backup generation",
+	Long: `Restores every file of a backup generation, or only the given paths and
+what is inside them. Whatever is at those paths now is replaced, links made by
+zetup included.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		gen, err := findBackupGeneration(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		entries := gen.Files
+		if len(args) > 1 {
+			entries = nil
+			for _, p := range args[1:] {
+				abs, err := filepath.Abs(p)
+				check(err)
+				// the parent may be a link zetup made into a package
+				if info, err := os.Lstat(filepath.Dir(abs)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+					log.Fatalf("%v is a link, restore it instead of %v", filepath.Dir(abs), p)
+				}
+				matched := false
+				for _, entry := range gen.Files {
+					if entry.Location == abs || strings.HasPrefix(entry.Location, abs+string(filepath.Separator)) {
+						entries = append(entries, entry)
+						matched = true
+					}
+				}
+				if !matched {
+					log.Fatalf("%v is not in generation %v", p, gen.ID)
+				}
+			}
+		}
+		err = restoreBackupEntries(entries)
+		check(err)
+		fmt.Printf("restored %v files from generation %v\n", len(entries), gen.ID)
+	},
+}
+
+var backupsPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "remove old backup generations",
+	Long: `Keeps the newest generations of the main package and of every subpackage
+and removes the rest. The backups "zetup unuse" restores are never removed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if backupsKeep < 1 {
+			log.Fatal("--keep must be at least 1")
+		}
+		pruned, err := pruneBackupGenerations(backupsKeep)
+		check(err)
+		for _, gen := range pruned {
+			fmt.Printf("removed generation %v (%v)\n", gen.ID, gen.Scope)
+		}
+		if len(pruned) == 0 {
+			fmt.Println("nothing to prune")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupsCmd)
+	backupsCmd.AddCommand(backupsListCmd)
+	backupsCmd.AddCommand(backupsShowCmd)
+	backupsCmd.AddCommand(backupsRestoreCmd)
+	backupsCmd.AddCommand(backupsPruneCmd)
+	backupsPruneCmd.Flags().IntVarP(&backupsKeep, "keep", "", 5,
+		"number of generations to keep per scope")
+}
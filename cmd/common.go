@@ -1,24 +1,34 @@
 package cmd
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
 
 	"github.com/spf13/viper"
 )
 
-// used by use and unuse
-type BackupFileInfo struct {
-	Location string `yaml:"location"`
-	Contents string `yaml:"contents"`
-}
-
 var err error
 
+// text or json, for commands that support --output
+var outputFormat string
+
+// pkgKey identifies a package by its path in pkgDir, e.g. github.com/user/repo
+func pkgKey(dir string) string {
+	rel, err := filepath.Rel(pkgDir, dir)
+	if err != nil {
+		return dir
+	}
+	return filepath.ToSlash(rel)
+}
+
 func FindFile(
 	dir string,
 	prefix string,
@@ -50,7 +60,7 @@ func FindFile(
 		if cmdFile == "" {
 			cmdFile = prefix
 		}
-		cmdFilePath = path.Join(usePkgDir, cmdFile)
+		cmdFilePath = path.Join(dir, cmdFile)
 		for _, ext := range extensions {
 			if _, err := os.Stat(cmdFilePath + ext); !os.IsNotExist(err) {
 				foundCmdFilePath = true
@@ -67,19 +77,141 @@ func FindFile(
 	}
 }
 
-func runFile(cmdFilePath string) {
-	err := os.Chmod(cmdFilePath, 0755)
+// runFile runs a script of the package in dir, or of its subpackage subpkg
+// in dir, from dir with the environment of scriptEnv
+func runFile(cmdFilePath string, dir string, subpkg string) error {
+	cmdFilePath, err := filepath.Abs(cmdFilePath)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-
-	runCmd := exec.Command(cmdFilePath)
-	runCmd.Env = append(os.Environ(), "ZETUP_USE_PKG="+usePkgDir)
+	runCmd, err := scriptCommand(cmdFilePath)
+	if err != nil {
+		return fmt.Errorf("%s %s", cmdFilePath, err)
+	}
+	runCmd.Dir = dir
+	runCmd.Env = append(os.Environ(), scriptEnv(dir, subpkg)...)
 	runCmd.Stdout = os.Stdout
 	runCmd.Stdin = os.Stdin
 	runCmd.Stderr = os.Stderr
 	err = runCmd.Run()
 	if err != nil {
-		log.Fatalf("%s %s\n", cmdFilePath, err)
+		return fmt.Errorf("%s %s", cmdFilePath, err)
+	}
+	return nil
+}
+
+// scriptCommand runs a script with the interpreter of its #! line or its
+// extension, so it doesn't have to be executable in the clone
+func scriptCommand(cmdFilePath string) (*exec.Cmd, error) {
+	f, err := os.Open(cmdFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	firstLine, _ := bufio.NewReader(f).ReadString('\n')
+	if strings.HasPrefix(firstLine, "#!") {
+		interpreter := strings.Fields(strings.TrimPrefix(firstLine, "#!"))
+		if len(interpreter) > 0 {
+			return exec.Command(interpreter[0], append(interpreter[1:], cmdFilePath)...), nil
+		}
+	}
+	switch path.Ext(cmdFilePath) {
+	case ".bash":
+		return exec.Command("bash", cmdFilePath), nil
+	case ".zsh":
+		return exec.Command("zsh", cmdFilePath), nil
+	}
+	if info, err := f.Stat(); err == nil && info.Mode()&0111 != 0 {
+		return exec.Command(cmdFilePath), nil
+	}
+	return exec.Command("sh", cmdFilePath), nil
+}
+
+// scriptEnv is what a script of the package in dir, or of its subpackage
+// subpkg in dir, gets on top of zetup's environment: the variables of
+// `zetup facts -o shell` for the package being applied, ZETUP_SUBPKG_DIR,
+// ZETUP_DIR, the user's name and email, and ZETUP_VAR_<NAME> for every entry
+// of vars
+func scriptEnv(dir string, subpkg string) []string {
+	pkgDir, subpkgDir := dir, ""
+	if subpkg != "" {
+		// subpackages live in <package>/subpkg/<name>
+		pkgDir, subpkgDir = path.Dir(path.Dir(dir)), dir
+	}
+
+	report := FactsReport{
+		Facts:          getFacts(),
+		InstallationID: installationId,
+		Pkg:            pkgKey(pkgDir),
+		PkgDir:         pkgDir,
+		Commit:         headCommit(pkgDir),
+	}
+	if usePkgDir == pkgDir {
+		report.Pkg = usePkgSource.String() + refSuffix(usePkgSource.Ref)
+		activeSubpkgs, _ := getActiveSubpkgs()
+		for _, activeSubpkg := range activeSubpkgs {
+			report.Subpkgs = append(report.Subpkgs, path.Base(activeSubpkg))
+		}
+	}
+	var env []string
+	for _, entry := range factEntries(report) {
+		env = append(env, entry.Env+"="+entry.Value)
+	}
+	env = append(env,
+		// ZETUP_USE_PKG is what scripts used to get, ZETUP_PKG_DIR is the same
+		"ZETUP_USE_PKG="+pkgDir,
+		"ZETUP_SUBPKG_DIR="+subpkgDir,
+		"ZETUP_DIR="+zetupDir,
+		"ZETUP_USER_NAME="+mainViper.GetString("user.name"),
+		"ZETUP_USER_EMAIL="+mainViper.GetString("user.email"),
+	)
+
+	// the package's vars, overridden by the subpackage's, like in templates
+	vars := map[string]interface{}{}
+	for key, value := range readPkgViper(pkgDir).GetStringMap("vars") {
+		vars[key] = value
+	}
+	if subpkgDir != "" {
+		for key, value := range readPkgViper(subpkgDir).GetStringMap("vars") {
+			vars[key] = value
+		}
+	}
+	for key, value := range vars {
+		env = append(env, "ZETUP_VAR_"+envName(key)+"="+fmt.Sprint(value))
+	}
+	return env
+}
+
+// envName turns a var like editor-font into EDITOR_FONT
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// runHook runs a hook of the package in dir, or of its subpackage subpkg in
+// dir, if it has one.
+// Hooks are found like the use script, post-link.linux, post-link.sh or
+// post-link, and run at these points:
+//
+//	pre-use     after its system packages are installed, before its use script
+//	post-link   after its files are linked
+//	post-use    after it is applied, for a package after its subpackages too
+//	pre-unuse   before anything is undone, for a package before its subpackages
+//	post-unuse  after it is undone
+func runHook(dir string, subpkg string, hook string, scriptViper *viper.Viper) error {
+	hookFile, err := FindFile(dir, hook, runtime.GOOS, LINUX_EXTENSIONS, scriptViper)
+	if err != nil {
+		return nil
+	}
+	if mainViper.GetBool("verbose") {
+		log.Printf("running %v hook %v\n", hook, hookFile)
 	}
+	return runFile(hookFile, dir, subpkg)
 }
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestScriptEnvDirs(t *testing.T) {
+	oldPkgDir, oldUsePkgDir := pkgDir, usePkgDir
+	defer func() {
+		pkgDir, usePkgDir = oldPkgDir, oldUsePkgDir
+	}()
+	pkgDir = "/zetup/pkg"
+	usePkgDir = ""
+
+	// an owner named subpkg is not a subpackage
+	dir := path.Join(pkgDir, "github.com/subpkg/foo")
+	tests := []struct {
+		dir, subpkg       string
+		pkgDir, subpkgDir string
+	}{
+		{dir, "", dir, ""},
+		{path.Join(dir, "subpkg/vim"), "vim", dir, path.Join(dir, "subpkg/vim")},
+	}
+	for _, test := range tests {
+		env := map[string]string{}
+		for _, entry := range scriptEnv(test.dir, test.subpkg) {
+			parts := strings.SplitN(entry, "=", 2)
+			env[parts[0]] = parts[1]
+		}
+		if env["ZETUP_PKG_DIR"] != test.pkgDir || env["ZETUP_SUBPKG_DIR"] != test.subpkgDir {
+			t.Errorf("scriptEnv(%q, %q): ZETUP_PKG_DIR=%q ZETUP_SUBPKG_DIR=%q, want %q %q", test.dir, test.subpkg,
+				env["ZETUP_PKG_DIR"], env["ZETUP_SUBPKG_DIR"], test.pkgDir, test.subpkgDir)
+		}
+	}
+}
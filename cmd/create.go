@@ -1,36 +1,221 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
+var createGithub bool
+var createPrivate bool
+
 // createCmd represents the create command
 var createCmd = &cobra.Command{
-	Use:   "create",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Use:   "create <name>",
+	Short: "create a new zetup package",
+	Long: `Creates a new zetup package with an example config.yml, use and unuse
+scripts, an example subpackage and an initialized git repository.
+
+The package is created in $ZETUP_DIR/pkg/github.com/<github-username>/<name>,
+so "zetup use <name>" works right away. Use --github to also create the
+repository on github and push the first commit to it.`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("create called")
+		pkgName := args[0]
+		if strings.ContainsAny(pkgName, `/\ `) {
+			log.Fatal("package name must not contain slashes or spaces")
+		}
+		githubUsername := mainViper.GetString("github-username")
+		newPkgDir := path.Join(pkgDir, "github.com", githubUsername, pkgName)
+		if _, err := os.Stat(newPkgDir); !os.IsNotExist(err) {
+			log.Fatalf("%v already exists", newPkgDir)
+		}
+
+		writeSkeleton(newPkgDir, pkgName)
+
+		r, err := git.PlainInit(newPkgDir, false)
+		check(err)
+		commitSkeleton(r, newPkgDir)
+
+		if createGithub {
+			createGithubRepo(pkgName, createPrivate)
+			_, err = r.CreateRemote(&config.RemoteConfig{
+				Name: "origin",
+				URLs: []string{"git@github.com:" + githubUsername + "/" + pkgName + ".git"},
+			})
+			check(err)
+			err = r.Push(&git.PushOptions{
+				RemoteName: "origin",
+				Auth:       githubSSHAuth(),
+			})
+			check(err)
+		}
+
+		fmt.Printf("created %v\n", newPkgDir)
+		fmt.Printf("run `zetup use %v` to use it\n", pkgName)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(createCmd)
+	createCmd.Flags().BoolVarP(&createGithub, "github", "", false,
+		"also create the repository on github")
+	createCmd.Flags().BoolVarP(&createPrivate, "private", "", false,
+		"make the github repository private")
+}
+
+// skeleton files, relative to the package directory
+var skeletonFiles = map[string]string{
+	"config.yml": `# zetup packages to use before this one, like with zetup use
+depends: []
+
+# packages to install with the system package manager, a name can be
+# given per manager (apt, dnf, yum, pacman, zypper, apk) when it differs
+packages:
+  - tree
+  - name: fd
+    apt: fd-find
+    dnf: fd-find
+
+# packages for one package manager only
+apt: []
+pacman: []
+
+# packages to install with snap
+snap:
+  - hello
 
-	// Here you will define your flags and configuration settings.
+# files to link, src and target are go templates
+# {{.Home}} is your home directory and {{.PkgDir}} is this package, also
+# available are .Facts (like .Facts.ID and .Facts.Hostname), .User, .Env,
+# .Vars and the functions env, default, joinPath, lower, upper and hasCommand
+#
+# mode is symlink, relative (a relative symlink), copy, hardlink or
+# template, link-mode sets the default for the whole package
+link-mode: symlink
+link:
+  - src: "{{.PkgDir}}/dotfiles/zetup-example"
+    target: "{{.Home}}/.zetup-example"
+    os: linux
+
+# files rendered through the same templates and written to target, for
+# files that differ per machine, same as a link with mode: template
+template: []
+#  - src: "{{.PkgDir}}/dotfiles/ssh_config"
+#    target: "{{.Home}}/.ssh/config"
+`,
+	"use.linux.sh": `#!/bin/sh
+# runs when this package is used, before files are linked
+echo "using {{name}}"
+`,
+	"unuse.linux.sh": `#!/bin/sh
+# runs when this package is unused, after backups are restored
+echo "unusing {{name}}"
+`,
+	"dotfiles/zetup-example": `# linked to ~/.zetup-example by config.yml
+`,
+	"subpkg/example/config.yml": `# subpackages take the same options as the main package
+apt: []
+snap: []
+link: []
+`,
+	"subpkg/example/use.linux.sh": `#!/bin/sh
+# runs when the example subpackage is used
+echo "using {{name}} example subpackage"
+`,
+	"README.md": `# {{name}}
+
+A [zetup](https://github.com/zetup-sh/zetup) package.
+
+    zetup use {{name}}
+`,
+}
+
+func writeSkeleton(dir string, pkgName string) {
+	for file, contents := range skeletonFiles {
+		filePath := path.Join(dir, file)
+		err := os.MkdirAll(path.Dir(filePath), 0755)
+		check(err)
+		var mode os.FileMode = 0644
+		if strings.HasSuffix(file, ".sh") {
+			mode = 0755
+		}
+		contents = strings.Replace(contents, "{{name}}", pkgName, -1)
+		err = ioutil.WriteFile(filePath, []byte(contents), mode)
+		check(err)
+	}
+}
+
+func commitSkeleton(r *git.Repository, dir string) {
+	w, err := r.Worktree()
+	check(err)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		_, err = w.Add(filepath.ToSlash(rel))
+		return err
+	})
+	check(err)
+	_, err = w.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  mainViper.GetString("user.name"),
+			Email: mainViper.GetString("user.email"),
+			When:  time.Now(),
+		},
+	})
+	check(err)
+}
+
+type CreateRepoPayload struct {
+	Name    string `json:"name"`
+	Private bool   `json:"private"`
+}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// createCmd.PersistentFlags().String("foo", "", "A help for foo")
+func createGithubRepo(name string, private bool) {
+	payloadBytes, err := json.Marshal(CreateRepoPayload{name, private})
+	if err != nil {
+		log.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", githubAPI("/user/repos"), bytes.NewReader(payloadBytes))
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokenHeader := fmt.Sprintf("token %v", mainViper.GetString("github-token"))
+	req.Header.Set("Authorization", tokenHeader)
+	req.Header.Set("Content-Type", "application/json")
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// createCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+		b, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("resp.StatusCode = %+v\n", resp.StatusCode)
+		log.Fatal(string(b))
+	}
 }
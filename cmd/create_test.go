@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestCreate(t *testing.T) {
+	dir, cleanup := withTestZetupDir(t)
+	defer cleanup()
+	mainViper.Set("user.name", "Me")
+	mainViper.Set("user.email", "me@example.com")
+	oldGithub := createGithub
+	defer func() {
+		createGithub = oldGithub
+	}()
+	createGithub = false
+
+	createCmd.Run(createCmd, []string{"demo"})
+
+	newPkgDir := path.Join(dir, "pkg", "github.com", "me", "demo")
+	var want []string
+	for file, contents := range skeletonFiles {
+		want = append(want, file)
+		dat, err := ioutil.ReadFile(path.Join(newPkgDir, file))
+		if err != nil {
+			t.Errorf("%v was not created: %v", file, err)
+			continue
+		}
+		if strings.Contains(string(dat), "{{name}}") {
+			t.Errorf("{{name}} is not replaced in %v", file)
+		}
+		if strings.Contains(contents, "{{name}}") && !strings.Contains(string(dat), "demo") {
+			t.Errorf("%v does not name the package", file)
+		}
+		info, err := os.Stat(path.Join(newPkgDir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(file, ".sh") && info.Mode()&0111 == 0 {
+			t.Errorf("%v is not executable", file)
+		}
+	}
+	sort.Strings(want)
+
+	// the example config is valid and links its example file
+	vip := viper.New()
+	vip.SetConfigFile(path.Join(newPkgDir, "config.yml"))
+	if err := vip.ReadInConfig(); err != nil {
+		t.Fatalf("config.yml does not parse: %v", err)
+	}
+	if links, ok := vip.Get("link").([]interface{}); !ok || len(links) != 1 {
+		t.Errorf("config.yml does not have the example link")
+	}
+	if _, err := os.Stat(path.Join(newPkgDir, "subpkg", "example")); err != nil {
+		t.Errorf("no example subpackage: %v", err)
+	}
+
+	// everything is in the initial commit
+	r, err := git.PlainOpen(newPkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := r.Head()
+	if err != nil {
+		t.Fatalf("no HEAD: %v", err)
+	}
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Author.Name != "Me" || commit.Author.Email != "me@example.com" || len(commit.ParentHashes) != 0 {
+		t.Errorf("the initial commit is %v <%v> with %v parents", commit.Author.Name, commit.Author.Email, len(commit.ParentHashes))
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var committed []string
+	err = tree.Files().ForEach(func(f *object.File) error {
+		committed = append(committed, f.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(committed)
+	if strings.Join(committed, " ") != strings.Join(want, " ") {
+		t.Errorf("committed %v, want %v", committed, want)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := w.Status(); err != nil || !status.IsClean() {
+		t.Errorf("the worktree is not clean after the initial commit: %v %v", status, err)
+	}
+}
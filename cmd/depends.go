@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// useDepends are the packages the package being used depends on, in the
+// order they are applied, set by ensureRepo
+//
+//	depends:
+//	  - zetup-sh/base
+//	  - github.com/me/dev-tools@v1.2.0
+var useDepends []PkgSource
+
+// resolveDepends clones everything root depends on, directly or through
+// other packages, and sorts it so every package comes after its
+// dependencies. Packages needed more than once are only in the list once,
+// root itself is not in it.
+func resolveDepends(root PkgSource) ([]PkgSource, error) {
+	var order []PkgSource
+	// done are the packages already in order, the stack is the path from
+	// root to the package being visited
+	done := map[string]PkgSource{}
+	var stack []string
+	var visit func(source PkgSource) error
+	visit = func(source PkgSource) error {
+		key := pkgKey(source.Dir())
+		if seen, ok := done[key]; ok {
+			if seen.Ref != source.Ref {
+				return fmt.Errorf("%v is needed at %v and at %v", key, refOrDefault(seen.Ref), refOrDefault(source.Ref))
+			}
+			return nil
+		}
+		for _, visiting := range stack {
+			if visiting == key {
+				return fmt.Errorf("dependency cycle: %v", strings.Join(append(stack, key), " -> "))
+			}
+		}
+		if len(stack) > 0 {
+			if err := cloneSource(source); err != nil {
+				return fmt.Errorf("could not get %v for %v: %v", source.String()+refSuffix(source.Ref), stack[len(stack)-1], err)
+			}
+		}
+
+		stack = append(stack, key)
+		for _, dep := range readPkgViper(source.Dir()).GetStringSlice("depends") {
+			depSource, err := parsePkgSource(dep)
+			if err != nil {
+				return fmt.Errorf("%v depends on %v: %v", key, dep, err)
+			}
+			if err := visit(lockedDepend(depSource)); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+
+		done[key] = source
+		order = append(order, source)
+		return nil
+	}
+	if err := visit(root); err != nil {
+		return nil, err
+	}
+	return order[:len(order)-1], nil
+}
+
+func refOrDefault(ref string) string {
+	if ref == "" {
+		return "the default branch"
+	}
+	return ref
+}
+
+// lockedDepend pins a dependency without a ref to its commit in the lock
+// for `zetup use --locked`
+func lockedDepend(source PkgSource) PkgSource {
+	if !lockedUse || source.Ref != "" {
+		return source
+	}
+	locked, err := readLock()
+	if err != nil {
+		return source
+	}
+	for _, dep := range locked.Depends {
+		if dep.Source == source.String() && dep.Commit != "" {
+			source.Ref = dep.Commit
+		}
+	}
+	return source
+}
+
+// recordUseDepends stores useDepends as use-pkg-depends, so unuse and update
+// know about them
+func recordUseDepends() {
+	journalRecord(JournalEntry{Action: "use-pkg-depends", Args: mainViper.GetStringSlice("use-pkg-depends")})
+	depends := []string{}
+	for _, dep := range useDepends {
+		depends = append(depends, dep.String()+refSuffix(dep.Ref))
+	}
+	mainViper.Set("use-pkg-depends", depends)
+	mainViper.WriteConfig()
+}
+
+// readUseDepends are the dependencies of the package in use
+func readUseDepends() ([]PkgSource, error) {
+	var depends []PkgSource
+	for _, dep := range mainViper.GetStringSlice("use-pkg-depends") {
+		source, err := parsePkgSource(dep)
+		if err != nil {
+			return nil, err
+		}
+		depends = append(depends, source)
+	}
+	return depends, nil
+}
+
+// withPkg runs f with source as the package zetup works on
+func withPkg(source PkgSource, f func() error) error {
+	oldSource, oldDir := usePkgSource, usePkgDir
+	defer func() {
+		usePkgSource, usePkgDir = oldSource, oldDir
+	}()
+	usePkgSource, usePkgDir = source, source.Dir()
+	return f()
+}
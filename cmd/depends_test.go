@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// testPkg makes the clone of file:///pkgs/<name> in pkgDir, depending on
+// the packages in depends, and returns its source
+func testPkg(t *testing.T, name string, depends ...string) PkgSource {
+	source, err := parsePkgSource("file:///pkgs/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := git.PlainInit(source.Dir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := "depends:\n"
+	for _, dep := range depends {
+		config += "  - file:///pkgs/" + dep + "\n"
+	}
+	if err := ioutil.WriteFile(path.Join(source.Dir(), "config.yml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("config.yml"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Commit("config", &git.CommitOptions{
+		Author: &object.Signature{Name: "zetup", Email: "zetup@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestResolveDepends(t *testing.T) {
+	oldPkgDir := pkgDir
+	defer func() {
+		pkgDir = oldPkgDir
+	}()
+
+	tests := []struct {
+		name string
+		// package: what it depends on, the first one is the root
+		pkgs  [][]string
+		order []string
+		err   string
+	}{
+		{
+			name:  "none",
+			pkgs:  [][]string{{"root"}},
+			order: nil,
+		},
+		{
+			name:  "diamond",
+			pkgs:  [][]string{{"root", "b", "c"}, {"b", "d"}, {"c", "d"}, {"d"}},
+			order: []string{"d", "b", "c"},
+		},
+		{
+			name:  "chain",
+			pkgs:  [][]string{{"root", "a"}, {"a", "b"}, {"b"}},
+			order: []string{"b", "a"},
+		},
+		{
+			name: "cycle",
+			pkgs: [][]string{{"root", "a"}, {"a", "b"}, {"b", "a"}},
+			err:  "dependency cycle: %root -> %a -> %b -> %a",
+		},
+		{
+			name: "root depends on itself",
+			pkgs: [][]string{{"root", "root"}},
+			err:  "dependency cycle: %root -> %root",
+		},
+		{
+			name: "dependency depends on itself",
+			pkgs: [][]string{{"root", "a"}, {"a", "a"}},
+			err:  "dependency cycle: %root -> %a -> %a",
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "zetup-depends")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkgDir = dir
+
+		keys := map[string]string{}
+		var root PkgSource
+		for i, pkg := range test.pkgs {
+			source := testPkg(t, pkg[0], pkg[1:]...)
+			keys[pkg[0]] = pkgKey(source.Dir())
+			if i == 0 {
+				root = source
+			}
+		}
+
+		order, err := resolveDepends(root)
+		if test.err != "" {
+			want := test.err
+			for name, key := range keys {
+				want = strings.Replace(want, "%"+name, key, -1)
+			}
+			if err == nil || err.Error() != want {
+				t.Errorf("%v: got error %v, want %v", test.name, err, want)
+			}
+		} else if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else {
+			var got []string
+			for _, source := range order {
+				got = append(got, path.Base(source.Dir()))
+			}
+			if strings.Join(got, " ") != strings.Join(test.order, " ") {
+				t.Errorf("%v: got order %v, want %v", test.name, got, test.order)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
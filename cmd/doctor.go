@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/zetup-sh/zetup/cmd/util"
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// DoctorResult is the outcome of one check, Status is pass, warn or fail
+type DoctorResult struct {
+	Check   string `json:"check"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+type doctorCheck struct {
+	Name string
+	Run  func() DoctorResult
+}
+
+// doctorChecks run in order, later checks may assume earlier ones passed
+var doctorChecks = []doctorCheck{
+	{"config", checkConfig},
+	{"journal", checkJournal},
+	{"ssh key files", checkKeyFiles},
+	{"github token", checkGithubToken},
+	{"github ssh key", checkGithubKey},
+	{"sudo", checkSudo},
+	{"pkg dir", checkPkgDir},
+	{"package clone", checkPkgClone},
+	{"links", checkLinks},
+}
+
+var doctorClient = &http.Client{Timeout: 10 * time.Second}
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "look for problems with the zetup setup",
+	Long: `Checks the config file, the ssh key, the github token, sudo, the package
+directory, the clone of the package in use and its links, and suggests a fix
+for everything that is wrong.
+
+Exits with 1 when a check fails.`,
+	Args: cobra.NoArgs,
+	// doctor checks what bootstrapping needs instead of doing it
+	Annotations: map[string]string{"bootstrap": "false"},
+	Run: func(cmd *cobra.Command, args []string) {
+		var results []DoctorResult
+		failed := false
+		for _, doctorCheck := range doctorChecks {
+			result := doctorCheck.Run()
+			result.Check = doctorCheck.Name
+			results = append(results, result)
+			if result.Status == "fail" {
+				failed = true
+			}
+		}
+		if outputFormat == "json" {
+			out, err := json.MarshalIndent(results, "", "  ")
+			check(err)
+			fmt.Println(string(out))
+		} else {
+			for _, result := range results {
+				fmt.Printf("%-4v  %-14v %v\n", result.Status, result.Check, result.Message)
+				if result.Fix != "" {
+					fmt.Printf("%20v %v\n", "fix:", result.Fix)
+				}
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().StringVarP(&outputFormat, "output", "o", "text",
+		"output format, text or json")
+}
+
+func doctorPass(message string) DoctorResult {
+	return DoctorResult{Status: "pass", Message: message}
+}
+
+func doctorWarn(message string, fix string) DoctorResult {
+	return DoctorResult{Status: "warn", Message: message, Fix: fix}
+}
+
+func doctorFail(message string, fix string) DoctorResult {
+	return DoctorResult{Status: "fail", Message: message, Fix: fix}
+}
+
+func checkConfig() DoctorResult {
+	if configErr != nil {
+		return doctorFail(fmt.Sprintf("could not read %v: %v", configFilePath(), configErr),
+			"fix the yaml by hand, or move the file away to start over")
+	}
+	return doctorPass(configFilePath())
+}
+
+func checkJournal() DoctorResult {
+	if util.Exists(journalFile()) {
+		return doctorFail("a previous zetup run did not finish", "run `zetup recover`")
+	}
+	return doctorPass("no unfinished runs")
+}
+
+func checkKeyFiles() DoctorResult {
+	privateKeyFile := mainViper.GetString("private-key-file")
+	publicKeyFile := mainViper.GetString("public-key-file")
+	newKey := "remove ssh-key-id from the config and run zetup to make a new key"
+	info, err := os.Stat(privateKeyFile)
+	if err != nil {
+		return doctorFail(fmt.Sprintf("no private key at %v", privateKeyFile), newKey)
+	}
+	if _, err := os.Stat(publicKeyFile); err != nil {
+		return doctorFail(fmt.Sprintf("no public key at %v", publicKeyFile), newKey)
+	}
+	// ssh refuses private keys others can read
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return doctorFail(fmt.Sprintf("%v has mode %o, others can read it", privateKeyFile, info.Mode().Perm()),
+			"chmod 600 "+privateKeyFile)
+	}
+	return doctorPass(privateKeyFile)
+}
+
+// githubGet calls the github api with the token in the config
+func githubGet(apiPath string) (int, []byte, error) {
+	req, err := http.NewRequest("GET", githubAPI(apiPath), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("token %v", mainViper.GetString("github-token")))
+	resp, err := doctorClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+func checkGithubToken() DoctorResult {
+	if mainViper.GetString("github-token") == "" {
+		return doctorWarn("no token yet", "run any zetup command to log in to github and make one")
+	}
+	status, body, err := githubGet("/user")
+	if err != nil {
+		return doctorWarn(fmt.Sprintf("could not reach github: %v", err),
+			"check your connection, or github-api-url if you set it")
+	}
+	switch {
+	case status == http.StatusUnauthorized:
+		return doctorFail("github rejected the token, it was probably revoked",
+			"remove github-token from the config and run zetup to make a new one")
+	case status < 200 || status > 299:
+		return doctorWarn(fmt.Sprintf("github answered %v", status), "try again later")
+	}
+	var user UserInfo
+	if err := json.Unmarshal(body, &user); err != nil {
+		return doctorWarn(fmt.Sprintf("could not read the answer from github: %v", err), "")
+	}
+	if username := mainViper.GetString("github-username"); username != "" && !strings.EqualFold(username, user.GithubUsername) {
+		return doctorFail(fmt.Sprintf("the token belongs to %v, not %v", user.GithubUsername, username),
+			"set github-username to "+user.GithubUsername+" or use a token of "+username)
+	}
+	return doctorPass("logged in as " + user.GithubUsername)
+}
+
+func checkGithubKey() DoctorResult {
+	newKey := "remove ssh-key-id from the config and run zetup to upload the key again"
+	sshKeyID := mainViper.GetString("ssh-key-id")
+	if sshKeyID == "" {
+		return doctorWarn("no key uploaded yet", "run any zetup command to upload one")
+	}
+	if mainViper.GetString("github-token") == "" {
+		return doctorWarn("could not check the key without a token", "")
+	}
+	status, body, err := githubGet("/user/keys/" + sshKeyID)
+	if err != nil {
+		return doctorWarn(fmt.Sprintf("could not reach github: %v", err), "")
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return doctorFail(fmt.Sprintf("key %v is not on github anymore", sshKeyID), newKey)
+	case status == http.StatusUnauthorized:
+		return doctorWarn("could not check the key, github rejected the token", "")
+	case status < 200 || status > 299:
+		return doctorWarn(fmt.Sprintf("github answered %v", status), "try again later")
+	}
+	var key struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(body, &key); err != nil {
+		return doctorWarn(fmt.Sprintf("could not read the answer from github: %v", err), "")
+	}
+	publicKeyFile := mainViper.GetString("public-key-file")
+	local, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return doctorFail(fmt.Sprintf("could not read %v", publicKeyFile), newKey)
+	}
+	// compare the type and key, not the comment
+	if !sameKey(string(local), key.Key) {
+		return doctorFail(fmt.Sprintf("key %v on github is not %v", sshKeyID, publicKeyFile), newKey)
+	}
+	return doctorPass(fmt.Sprintf("key %v matches %v", sshKeyID, publicKeyFile))
+}
+
+func sameKey(a string, b string) bool {
+	aFields := strings.Fields(a)
+	bFields := strings.Fields(b)
+	if len(aFields) < 2 || len(bFields) < 2 {
+		return false
+	}
+	return aFields[0] == bFields[0] && aFields[1] == bFields[1]
+}
+
+func checkSudo() DoctorResult {
+	if runtime.GOOS != "linux" {
+		return doctorPass("not needed on " + runtime.GOOS)
+	}
+	if !hasCommand("sudo") {
+		return doctorFail("sudo is not installed, zetup can't install packages",
+			"install sudo and add yourself to the sudo or wheel group")
+	}
+	out, err := exec.Command("sudo", "-n", "true").CombinedOutput()
+	if err == nil {
+		return doctorPass("sudo works without a password")
+	}
+	// sudo -n asks for the password before it checks the sudoers file, so
+	// whether the user may use sudo at all is told by their groups
+	if strings.Contains(string(out), "password is required") && inSudoGroup() {
+		return doctorPass("sudo will ask for your password")
+	}
+	return doctorFail("you are not allowed to use sudo, zetup can't install packages",
+		"add yourself to the sudo or wheel group")
+}
+
+// inSudoGroup is whether the user is in a group that may use sudo on the
+// common distros
+func inSudoGroup() bool {
+	out, err := exec.Command("id", "-Gn").Output()
+	if err != nil {
+		return false
+	}
+	for _, group := range strings.Fields(string(out)) {
+		if group == "sudo" || group == "wheel" || group == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPkgDir() DoctorResult {
+	tmpFile, err := ioutil.TempFile(pkgDir, ".doctor")
+	if err != nil {
+		return doctorFail(fmt.Sprintf("can't write to %v: %v", pkgDir, err),
+			"chown -R $USER "+pkgDir+", or set pkg-dir to somewhere you can write")
+	}
+	tmpFile.Close()
+	os.Remove(tmpFile.Name())
+	return doctorPass(pkgDir)
+}
+
+func checkPkgClone() DoctorResult {
+	usePkgDir = mainViper.GetString("use-pkg")
+	if usePkgDir == "" {
+		return doctorPass("no package in use")
+	}
+	reuse := "run `zetup use " + mainViper.GetString("use-pkg-source") + "` again"
+	if _, err := git.PlainOpen(usePkgDir); err != nil {
+		return doctorFail(fmt.Sprintf("could not open %v: %v", usePkgDir, err), reuse)
+	}
+	commit := mainViper.GetString("use-pkg-commit")
+	if head := headCommit(usePkgDir); commit != "" && head != commit {
+		return doctorWarn(fmt.Sprintf("%.7v is checked out, but %.7v was applied", head, commit), reuse)
+	}
+	return doctorPass(usePkgDir)
+}
+
+func checkLinks() DoctorResult {
+	if mainViper.GetString("use-pkg") == "" {
+		return doctorPass("no package in use")
+	}
+	usePkgDir = mainViper.GetString("use-pkg")
+	if !util.Exists(usePkgDir) {
+		return doctorFail(usePkgDir+" is gone", "run `zetup use "+mainViper.GetString("use-pkg-source")+"` again")
+	}
+	links, err := linkStatuses()
+	if err != nil {
+		return doctorFail(err.Error(), "fix config.yml of the package")
+	}
+	var notOk []string
+	for _, link := range links {
+		if link.State != "ok" {
+			notOk = append(notOk, fmt.Sprintf("%v (%v)", link.Target, link.State))
+		}
+	}
+	if len(notOk) > 0 {
+		return doctorWarn(strings.Join(notOk, ", "), "run `zetup use` to link again, see `zetup status` for details")
+	}
+	return doctorPass(fmt.Sprintf("%v links in place", len(links)))
+}
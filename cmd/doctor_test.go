@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// fakeGithub answers like the github api for the token "good" and key 5
+func fakeGithub(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("Authorization") != "token good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/user":
+			fmt.Fprint(w, `{"login": "me"}`)
+		case "/user/keys/5":
+			fmt.Fprint(w, `{"id": 5, "key": "ssh-rsa AAAAB3Nza"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestDoctorGithub(t *testing.T) {
+	oldViper, oldURL := mainViper, githubAPIURL
+	defer func() {
+		mainViper, githubAPIURL = oldViper, oldURL
+	}()
+	dir, err := ioutil.TempDir("", "zetup-doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	publicKeyFile := path.Join(dir, "zetup_id_rsa.pub")
+	err = ioutil.WriteFile(publicKeyFile, []byte("ssh-rsa AAAAB3Nza zetup-laptop\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := fakeGithub(http.StatusOK)
+	defer ok.Close()
+	broken := fakeGithub(http.StatusInternalServerError)
+	defer broken.Close()
+	// nothing listens on the url of a closed server
+	unreachable := fakeGithub(http.StatusOK)
+	unreachable.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		token    string
+		keyID    string
+		check    func() DoctorResult
+		status   string
+		contains string
+	}{
+		{"token ok", ok.URL, "good", "5", checkGithubToken, "pass", "logged in as me"},
+		{"token revoked", ok.URL, "revoked", "5", checkGithubToken, "fail", "rejected the token"},
+		{"token unreachable", unreachable.URL, "good", "5", checkGithubToken, "warn", "could not reach github"},
+		{"token bad status", broken.URL, "good", "5", checkGithubToken, "warn", "github answered 500"},
+		{"key ok", ok.URL, "good", "5", checkGithubKey, "pass", "matches"},
+		{"key removed", ok.URL, "good", "6", checkGithubKey, "fail", "not on github anymore"},
+		{"key unreachable", unreachable.URL, "good", "5", checkGithubKey, "warn", "could not reach github"},
+		{"key bad status", broken.URL, "good", "5", checkGithubKey, "warn", "github answered 500"},
+	}
+	for _, test := range tests {
+		mainViper = viper.New()
+		mainViper.Set("github-username", "me")
+		mainViper.Set("public-key-file", publicKeyFile)
+		mainViper.Set("github-token", test.token)
+		mainViper.Set("ssh-key-id", test.keyID)
+		githubAPIURL = test.url
+
+		result := test.check()
+		if result.Status != test.status || !strings.Contains(result.Message, test.contains) {
+			t.Errorf("%v: got %v %q, want %v %q", test.name, result.Status, result.Message, test.status, test.contains)
+		}
+	}
+}
+
+// fakeCommand writes a script called name to dir that prints out to stderr
+// and exits with code
+func fakeCommand(t *testing.T, dir string, name string, out string, code int) {
+	script := fmt.Sprintf("#!/bin/sh\necho '%v' >&2\nexit %v\n", out, code)
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDoctorSudo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sudo is only checked on linux")
+	}
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	tests := []struct {
+		name     string
+		sudo     string
+		sudoCode int
+		groups   string
+		status   string
+		contains string
+	}{
+		// a code of -1 leaves sudo out
+		{"not installed", "", -1, "me sudo", "fail", "not installed"},
+		{"no password", "", 0, "me", "pass", "without a password"},
+		{"password", "sudo: a password is required", 1, "me sudo", "pass", "ask for your password"},
+		{"password in wheel", "sudo: a password is required", 1, "me wheel", "pass", "ask for your password"},
+		{"password but no group", "sudo: a password is required", 1, "me users", "fail", "not allowed"},
+		{"not a sudoer", "me is not in the sudoers file.", 1, "me sudo", "fail", "not allowed"},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "zetup-sudo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// id prints the groups to stdout
+		script := fmt.Sprintf("#!/bin/sh\necho '%v'\n", test.groups)
+		if err := ioutil.WriteFile(path.Join(dir, "id"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if test.sudoCode >= 0 {
+			fakeCommand(t, dir, "sudo", test.sudo, test.sudoCode)
+		}
+		os.Setenv("PATH", dir)
+
+		result := checkSudo()
+		if result.Status != test.status || !strings.Contains(result.Message, test.contains) {
+			t.Errorf("%v: got %v %q, want %v %q", test.name, result.Status, result.Message, test.status, test.contains)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/zetup-sh/zetup/cmd/facts"
+)
+
+// FactsReport is everything zetup knows about the machine and what is in use
+type FactsReport struct {
+	facts.Facts
+	InstallationID string   `json:"installationId"`
+	Pkg            string   `json:"pkg"`
+	PkgDir         string   `json:"pkgDir"`
+	Commit         string   `json:"commit"`
+	Subpkgs        []string `json:"subpkgs"`
+}
+
+// a fact as printed by `zetup facts`, Env is the variable name for --output shell
+type factEntry struct {
+	Name, Env, Value string
+}
+
+// factsCmd represents the facts command
+var factsCmd = &cobra.Command{
+	Use:   "facts",
+	Short: "print what zetup knows about this machine",
+	Long: `Prints the system facts zetup uses to pick package managers, links and
+subpackages, along with the installation id and the package in use.
+
+Use --output json for scripts, or --output shell to get export lines:
+
+  eval "$(zetup facts -o shell)"
+
+Facts can be overridden for testing with --facts-file.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		report := buildFactsReport()
+		switch outputFormat {
+		case "json":
+			out, err := json.MarshalIndent(report, "", "  ")
+			check(err)
+			fmt.Println(string(out))
+		case "shell":
+			for _, entry := range factEntries(report) {
+				fmt.Printf("export %v=%v\n", entry.Env, shellQuote(entry.Value))
+			}
+		case "text":
+			for _, entry := range factEntries(report) {
+				fmt.Printf("%-16v %v\n", entry.Name+":", entry.Value)
+			}
+		default:
+			log.Fatalf("unknown output format %v, use text, json or shell", outputFormat)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(factsCmd)
+	factsCmd.Flags().StringVarP(&outputFormat, "output", "o", "text",
+		"output format, text, json or shell")
+}
+
+func buildFactsReport() FactsReport {
+	report := FactsReport{
+		Facts:          getFacts(),
+		InstallationID: installationId,
+		Pkg:            mainViper.GetString("use-pkg-source"),
+		PkgDir:         mainViper.GetString("use-pkg"),
+		Commit:         mainViper.GetString("use-pkg-commit"),
+		Subpkgs:        []string{},
+	}
+	if ref := mainViper.GetString("use-pkg-ref"); ref != "" {
+		report.Pkg += "@" + ref
+	}
+	if report.PkgDir != "" {
+		usePkgDir = report.PkgDir
+		subpkgDirs, err := getActiveSubpkgs()
+		check(err)
+		for _, subpkgDir := range subpkgDirs {
+			report.Subpkgs = append(report.Subpkgs, path.Base(subpkgDir))
+		}
+	}
+	return report
+}
+
+func factEntries(report FactsReport) []factEntry {
+	return []factEntry{
+		{"os", "ZETUP_OS", report.OS},
+		{"arch", "ZETUP_ARCH", report.Arch},
+		{"kernel", "ZETUP_KERNEL", report.Kernel},
+		{"distro", "ZETUP_DISTRO", report.Distro},
+		{"id", "ZETUP_DISTRO_ID", report.ID},
+		{"id-like", "ZETUP_DISTRO_ID_LIKE", strings.Join(report.IDLike, " ")},
+		{"version-id", "ZETUP_VERSION_ID", report.VersionID},
+		{"code-name", "ZETUP_CODE_NAME", report.CodeName},
+		{"hostname", "ZETUP_HOSTNAME", report.Hostname},
+		{"user", "ZETUP_USER", report.User},
+		{"home", "ZETUP_HOME", report.Home},
+		{"shell", "ZETUP_SHELL", report.Shell},
+		{"cpus", "ZETUP_CPUS", strconv.Itoa(report.CPUs)},
+		{"installation-id", "ZETUP_INSTALLATION_ID", report.InstallationID},
+		{"pkg", "ZETUP_PKG", report.Pkg},
+		{"pkg-dir", "ZETUP_PKG_DIR", report.PkgDir},
+		{"commit", "ZETUP_COMMIT", report.Commit},
+		{"subpkgs", "ZETUP_SUBPKGS", strings.Join(report.Subpkgs, " ")},
+	}
+}
@@ -0,0 +1,162 @@
+// Package facts detects what zetup needs to know about the machine
+package facts
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Facts describes the machine zetup is running on
+type Facts struct {
+	OS   string `yaml:"os" json:"os"`
+	Arch string `yaml:"arch" json:"arch"`
+	// Kernel is the kernel release, like 4.15.0-54-generic
+	Kernel string `yaml:"kernel" json:"kernel"`
+
+	// from /etc/os-release, ID is lowercase like ubuntu and IDLike lists
+	// the distros it is based on, like [debian]
+	ID        string   `yaml:"id" json:"id"`
+	IDLike    []string `yaml:"id-like" json:"idLike"`
+	Distro    string   `yaml:"distro" json:"distro"`
+	VersionID string   `yaml:"version-id" json:"versionId"`
+	CodeName  string   `yaml:"code-name" json:"codeName"`
+
+	Hostname string `yaml:"hostname" json:"hostname"`
+	User     string `yaml:"user" json:"user"`
+	Home     string `yaml:"home" json:"home"`
+	Shell    string `yaml:"shell" json:"shell"`
+	CPUs     int    `yaml:"cpus" json:"cpus"`
+}
+
+// OSReleaseFile is read on linux
+var OSReleaseFile = "/etc/os-release"
+
+// Gather detects the facts of this machine, any fact set in overrideFile
+// (a yaml file with the same keys as Facts) replaces the detected one
+func Gather(overrideFile string) (Facts, error) {
+	f := Facts{
+		OS:     runtime.GOOS,
+		Arch:   uname("-m", runtime.GOARCH),
+		Kernel: uname("-r", ""),
+		Shell:  os.Getenv("SHELL"),
+		CPUs:   runtime.NumCPU(),
+	}
+	f.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		f.User = u.Username
+		f.Home = u.HomeDir
+	} else {
+		f.User = os.Getenv("USER")
+		f.Home = os.Getenv("HOME")
+	}
+
+	if runtime.GOOS == "linux" {
+		if file, err := os.Open(OSReleaseFile); err == nil {
+			f.setOSRelease(ParseOSRelease(file))
+			file.Close()
+		}
+	}
+
+	if overrideFile != "" {
+		dat, err := ioutil.ReadFile(overrideFile)
+		if err != nil {
+			return f, err
+		}
+		if err := yaml.Unmarshal(dat, &f); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func (f *Facts) setOSRelease(osRelease map[string]string) {
+	f.ID = strings.ToLower(osRelease["ID"])
+	f.IDLike = strings.Fields(strings.ToLower(osRelease["ID_LIKE"]))
+	f.Distro = osRelease["PRETTY_NAME"]
+	if f.Distro == "" {
+		f.Distro = osRelease["NAME"]
+	}
+	f.VersionID = osRelease["VERSION_ID"]
+	f.CodeName = osRelease["VERSION_CODENAME"]
+	// some ubuntu releases only set UBUNTU_CODENAME
+	if f.CodeName == "" {
+		f.CodeName = osRelease["UBUNTU_CODENAME"]
+	}
+}
+
+// ParseOSRelease parses the KEY=value lines of an os-release file, values
+// can be quoted and comments and blank lines are skipped
+func ParseOSRelease(r io.Reader) map[string]string {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		values[parts[0]] = unquote(parts[1])
+	}
+	return values
+}
+
+// values follow shell quoting, single quoted values are taken literally
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1]
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return strings.NewReplacer(`\"`, `"`, `\$`, `$`, "\\`", "`", `\\`, `\`).Replace(value)
+}
+
+// IsLike is true when the distro is id or is based on it
+func (f Facts) IsLike(id string) bool {
+	if f.ID == id {
+		return true
+	}
+	for _, like := range f.IDLike {
+		if like == id {
+			return true
+		}
+	}
+	return false
+}
+
+// goArches maps what `uname -m` prints to the GOARCH name
+var goArches = map[string]string{
+	"x86_64":  "amd64",
+	"i386":    "386",
+	"i686":    "386",
+	"aarch64": "arm64",
+	"armv6l":  "arm",
+	"armv7l":  "arm",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// IsArch is true when the machine is arch, as uname -m or GOARCH names it,
+// like x86_64 or amd64
+func (f Facts) IsArch(arch string) bool {
+	return f.Arch == arch || goArches[f.Arch] == arch
+}
+
+func uname(flag string, fallback string) string {
+	out, err := exec.Command("uname", flag).Output()
+	if err != nil {
+		return fallback
+	}
+	return strings.TrimSpace(string(out))
+}
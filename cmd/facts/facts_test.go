@@ -0,0 +1,92 @@
+package facts
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsArch(t *testing.T) {
+	tests := []struct {
+		machine, arch string
+		want          bool
+	}{
+		{"x86_64", "x86_64", true},
+		{"x86_64", "amd64", true},
+		{"x86_64", "arm64", false},
+		{"aarch64", "arm64", true},
+		{"armv7l", "arm", true},
+		{"amd64", "amd64", true},
+	}
+	for _, test := range tests {
+		if got := (Facts{Arch: test.machine}).IsArch(test.arch); got != test.want {
+			t.Errorf("IsArch(%q) on %v = %v, want %v", test.arch, test.machine, got, test.want)
+		}
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	osRelease := `# comments and blank lines are skipped
+
+NAME="Ubuntu"
+ID=ubuntu
+ID_LIKE=debian
+PRETTY_NAME="Ubuntu 18.04.2 LTS"
+VERSION_ID='18.04'
+UBUNTU_CODENAME=bionic
+QUOTED="say \"hi\" for \$5"
+NOT A KEY VALUE LINE
+`
+	values := ParseOSRelease(strings.NewReader(osRelease))
+	tests := []struct {
+		key, want string
+	}{
+		{"NAME", "Ubuntu"},
+		{"ID", "ubuntu"},
+		{"ID_LIKE", "debian"},
+		{"PRETTY_NAME", "Ubuntu 18.04.2 LTS"},
+		{"VERSION_ID", "18.04"},
+		{"UBUNTU_CODENAME", "bionic"},
+		{"QUOTED", `say "hi" for $5`},
+		{"VERSION_CODENAME", ""},
+	}
+	for _, test := range tests {
+		if got := values[test.key]; got != test.want {
+			t.Errorf("%v = %q, want %q", test.key, got, test.want)
+		}
+	}
+	if _, ok := values["VERSION_CODENAME"]; ok {
+		t.Errorf("missing key VERSION_CODENAME is set")
+	}
+	if len(values) != 7 {
+		t.Errorf("got %v values, want 7: %v", len(values), values)
+	}
+}
+
+func TestSetOSRelease(t *testing.T) {
+	tests := []struct {
+		osRelease string
+		want      Facts
+	}{
+		{
+			// missing PRETTY_NAME and VERSION_CODENAME
+			"ID=Pop\nID_LIKE=\"ubuntu debian\"\nNAME=\"Pop!_OS\"\nUBUNTU_CODENAME=bionic\n",
+			Facts{ID: "pop", IDLike: []string{"ubuntu", "debian"}, Distro: "Pop!_OS", CodeName: "bionic"},
+		},
+		{
+			"ID=fedora\nPRETTY_NAME=\"Fedora 30\"\nVERSION_ID=30\n",
+			Facts{ID: "fedora", IDLike: []string{}, Distro: "Fedora 30", VersionID: "30"},
+		},
+	}
+	for _, test := range tests {
+		var f Facts
+		f.setOSRelease(ParseOSRelease(strings.NewReader(test.osRelease)))
+		if !reflect.DeepEqual(f, test.want) {
+			t.Errorf("got %+v, want %+v", f, test.want)
+		}
+	}
+	pop := tests[0].want
+	if !pop.IsLike("debian") || !pop.IsLike("pop") || pop.IsLike("fedora") {
+		t.Errorf("IsLike is wrong for %+v", pop)
+	}
+}
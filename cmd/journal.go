@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/zetup-sh/zetup/cmd/util"
+	"gopkg.in/yaml.v2"
+)
+
+// Journal records every completed step of a `zetup use` so the steps can be
+// undone in reverse order if a later one fails or zetup is interrupted
+type Journal struct {
+	Pkg     string         `yaml:"pkg"`
+	PkgDir  string         `yaml:"pkg-dir"`
+	Started time.Time      `yaml:"started"`
+	Entries []JournalEntry `yaml:"entries"`
+}
+
+type JournalEntry struct {
+	Action string   `yaml:"action"`
+	Scope  string   `yaml:"scope,omitempty"`
+	Dir    string   `yaml:"dir,omitempty"`
+	Args   []string `yaml:"args,omitempty"`
+	// Snapshot is how the targets of a link entry were before linking
+	Snapshot *LinkSnapshot `yaml:"snapshot,omitempty"`
+}
+
+var journal *Journal
+
+var interrupts = make(chan os.Signal, 1)
+var interruptedBy os.Signal
+
+func journalFile() string {
+	return path.Join(zetupDir, "journal.yml")
+}
+
+func ensureNoJournal() {
+	if util.Exists(journalFile()) {
+		log.Fatal("a previous zetup run did not finish, run `zetup recover` first")
+	}
+}
+
+func beginJournal(pkg string, dir string) {
+	journal = &Journal{
+		Pkg:     pkg,
+		PkgDir:  dir,
+		Started: time.Now(),
+	}
+	writeJournal()
+}
+
+func readJournal() (*Journal, error) {
+	dat, err := ioutil.ReadFile(journalFile())
+	if err != nil {
+		return nil, err
+	}
+	var j Journal
+	err = yaml.Unmarshal(dat, &j)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func writeJournal() {
+	marshaled, err := yaml.Marshal(journal)
+	check(err)
+	withHeader := []byte("# generated file do not edit, use `zetup recover`\n" + string(marshaled))
+	err = ioutil.WriteFile(journalFile(), withHeader, 0644)
+	check(err)
+}
+
+// journalRecord is a no-op outside of a journaled run
+func journalRecord(entry JournalEntry) {
+	if journal == nil {
+		return
+	}
+	journal.Entries = append(journal.Entries, entry)
+	writeJournal()
+}
+
+// journalRecordRc snapshots the rc index before a package registers fragments
+func journalRecordRc() {
+	dat, err := ioutil.ReadFile(path.Join(rcDir, "index.yml"))
+	if err != nil && !os.IsNotExist(err) {
+		check(err)
+	}
+	journalRecord(JournalEntry{Action: "rc", Args: []string{string(dat)}})
+}
+
+func finishJournal() {
+	err := os.Remove(journalFile())
+	if err != nil && !os.IsNotExist(err) {
+		check(err)
+	}
+	journal = nil
+}
+
+// checkInterrupted returns an error once zetup has received ctrl-c
+func checkInterrupted() error {
+	select {
+	case sig := <-interrupts:
+		interruptedBy = sig
+	default:
+	}
+	if interruptedBy != nil {
+		return fmt.Errorf("interrupted by %v", interruptedBy)
+	}
+	return nil
+}
+
+// runJournaled runs apply and rolls back everything it recorded if it fails
+func runJournaled(apply func() error) {
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+
+	err := apply()
+	if err == nil {
+		err = checkInterrupted()
+	}
+	if err != nil {
+		log.Println(err)
+		log.Println("rolling back...")
+		if !rollbackJournal() {
+			log.Fatal("could not roll back everything, run `zetup recover` to try again")
+		}
+		log.Fatal("rolled back")
+	}
+	finishJournal()
+}
+
+// rollbackJournal undoes entries in reverse order, entries that could not be
+// undone are kept in the journal for `zetup recover`
+func rollbackJournal() bool {
+	var failed []JournalEntry
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		entry := journal.Entries[i]
+		if mainViper.GetBool("verbose") {
+			log.Printf("undoing %v %v %v\n", entry.Action, entry.Scope, entry.Args)
+		}
+		if err := undoJournalEntry(entry); err != nil {
+			log.Printf("could not undo %v: %v\n", entry.Action, err)
+			failed = append([]JournalEntry{entry}, failed...)
+		}
+	}
+	if len(failed) > 0 {
+		journal.Entries = failed
+		writeJournal()
+		return false
+	}
+	finishJournal()
+	return true
+}
+
+func undoJournalEntry(entry JournalEntry) error {
+	// <manager>-install, like apt-install or snap-install
+	if manager, ok := packageManagers[strings.TrimSuffix(entry.Action, "-install")]; ok {
+		// the install may have stopped halfway
+		var installed []string
+		for _, pkg := range entry.Args {
+			if ok, _ := manager.Installed(pkg); ok {
+				installed = append(installed, pkg)
+			}
+		}
+		if err := manager.Remove(installed); err != nil {
+			return err
+		}
+		for _, pkg := range entry.Args {
+			recordInstalled(manager, pkg, "", "")
+		}
+		mainViper.WriteConfig()
+		return nil
+	}
+	switch entry.Action {
+	case "run-use":
+		// Args holds the subpackage, if it was one
+		subpkg := ""
+		if len(entry.Args) > 0 {
+			subpkg = entry.Args[0]
+		}
+		unuseFile, err := FindFile(entry.Dir, "unuse", runtime.GOOS, LINUX_EXTENSIONS, readPkgViper(entry.Dir))
+		if err == nil {
+			return runFile(unuseFile, entry.Dir, subpkg)
+		}
+	case "link":
+		return restoreLinkSnapshot(entry.Scope, *entry.Snapshot)
+	case "rc":
+		var fragments []RcFragment
+		if err := yaml.Unmarshal([]byte(entry.Args[0]), &fragments); err != nil {
+			return err
+		}
+		writeRcIndex(fragments)
+	case "use-pkg":
+		setUsePkg(entry.Args[0], entry.Args[1], entry.Args[2], entry.Args[3])
+		mainViper.WriteConfig()
+	case "applied-subpkgs":
+		mainViper.Set("applied-subpkgs", append([]string{}, entry.Args...))
+		mainViper.WriteConfig()
+	case "subpkg-selection":
+		mainViper.Set("use-pkg-only", splitList(entry.Args[0]))
+		mainViper.Set("use-pkg-skip", splitList(entry.Args[1]))
+		mainViper.WriteConfig()
+	case "package-records":
+		records := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(entry.Args[0]), &records); err != nil {
+			return err
+		}
+		mainViper.Set("installed-"+entry.Scope, records)
+		mainViper.WriteConfig()
+	case "use-pkg-depends":
+		mainViper.Set("use-pkg-depends", append([]string{}, entry.Args...))
+		mainViper.WriteConfig()
+	default:
+		return fmt.Errorf("unknown journal action %v", entry.Action)
+	}
+	return nil
+}
+
+func readPkgViper(dir string) *viper.Viper {
+	vip := viper.New()
+	vip.AddConfigPath(dir)
+	vip.SetConfigName("config")
+	_ = vip.ReadInConfig()
+	return vip
+}
+
+func runSudo(args ...string) error {
+	runCmd := exec.Command("sudo", args...)
+	runCmd.Stdout = os.Stdout
+	runCmd.Stdin = os.Stdin
+	runCmd.Stderr = os.Stderr
+	return runCmd.Run()
+}
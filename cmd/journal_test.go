@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestRollbackJournal(t *testing.T) {
+	tests := []struct {
+		name string
+		// before puts what the user had at target
+		before func(target string) error
+		// used is whether the package was linked before the journaled run
+		used bool
+	}{
+		{
+			name:   "nothing there",
+			before: func(target string) error { return nil },
+		},
+		{
+			name: "file",
+			before: func(target string) error {
+				if err := ioutil.WriteFile(target, []byte("mine"), 0600); err != nil {
+					return err
+				}
+				return os.Chmod(target, 0600)
+			},
+		},
+		{
+			name: "symlink",
+			before: func(target string) error {
+				return os.Symlink("/somewhere/else", target)
+			},
+		},
+		{
+			name: "directory",
+			before: func(target string) error {
+				if err := os.Mkdir(target, 0755); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(path.Join(target, "inside"), []byte("mine"), 0644)
+			},
+		},
+		{
+			name: "package used before",
+			before: func(target string) error {
+				return ioutil.WriteFile(target, []byte("mine"), 0644)
+			},
+			used: true,
+		},
+	}
+
+	for _, test := range tests {
+		dir, cleanup := withTestZetupDir(t)
+
+		src := path.Join(usePkgDir, "bashrc")
+		target := path.Join(dir, "home-bashrc")
+		if err := ioutil.WriteFile(src, []byte("zetup's"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(path.Join(usePkgDir, "rc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(usePkgDir, "rc", "aliases.sh"), []byte("alias g=git"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.before(target); err != nil {
+			t.Fatal(err)
+		}
+		original := describeTree(t, target)
+
+		vip := viper.New()
+		vip.Set("link", []interface{}{
+			map[interface{}]interface{}{"src": src, "target": target},
+		})
+		scope := backupScope("")
+		if test.used {
+			if err := LinkFiles(vip, scope); err != nil {
+				t.Fatal(err)
+			}
+			// the user replaced the link since, so it is linked again
+			if err := os.Remove(target); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("/tmp/changed-by-hand", target); err != nil {
+				t.Fatal(err)
+			}
+		}
+		linked := describeTree(t, target)
+		userFragment := RcFragment{Name: "mine", Order: defaultRcOrder, Path: path.Join(rcDir, "fragments", "mine.sh")}
+		writeRcIndex([]RcFragment{userFragment})
+
+		beginJournal("github.com/me/dotfiles", usePkgDir)
+		if err := LinkFiles(vip, scope); err != nil {
+			t.Fatal(err)
+		}
+		journalRecordRc()
+		registerRcFragments(usePkgDir, pkgKey(usePkgDir), "")
+		setSubpkgApplied("vim", true)
+		if len(readRcIndex()) != 2 || !subpkgApplied("vim") {
+			t.Fatalf("%v: the run did not change the rc index or applied subpackages", test.name)
+		}
+
+		if !rollbackJournal() {
+			t.Fatalf("%v: could not roll back", test.name)
+		}
+		if after := describeTree(t, target); !reflect.DeepEqual(after, linked) {
+			t.Errorf("%v: rolled back to %q, want %q", test.name, after, linked)
+		}
+		if fragments := readRcIndex(); !reflect.DeepEqual(fragments, []RcFragment{userFragment}) {
+			t.Errorf("%v: rc index is %+v after the rollback", test.name, fragments)
+		}
+		if subpkgApplied("vim") {
+			t.Errorf("%v: vim is still applied after the rollback", test.name)
+		}
+		if _, err := os.Stat(journalFile()); !os.IsNotExist(err) {
+			t.Errorf("%v: the journal is still there", test.name)
+		}
+
+		// what the user had before zetup is still in the backups
+		if err := restoreBackupScope(scope); err != nil {
+			t.Fatal(err)
+		}
+		if after := describeTree(t, target); !reflect.DeepEqual(after, original) {
+			t.Errorf("%v: unuse restores %q, want %q", test.name, after, original)
+		}
+		cleanup()
+	}
+}
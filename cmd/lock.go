@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// Lock is the resolved state of the package in use, written to
+// $ZETUP_DIR/zetup.lock after every successful `zetup use`
+type Lock struct {
+	Source   string        `yaml:"source"`
+	Ref      string        `yaml:"ref,omitempty"`
+	Commit   string        `yaml:"commit"`
+	Depends  []LockDepend  `yaml:"depends,omitempty"`
+	Subpkgs  []LockSubpkg  `yaml:"subpkgs,omitempty"`
+	Packages []LockPackage `yaml:"packages,omitempty"`
+	Links    []LockLink    `yaml:"links,omitempty"`
+}
+
+type LockDepend struct {
+	Source string `yaml:"source"`
+	Ref    string `yaml:"ref,omitempty"`
+	Commit string `yaml:"commit"`
+}
+
+type LockSubpkg struct {
+	Path string `yaml:"path"`
+	Hash string `yaml:"hash"`
+}
+
+type LockPackage struct {
+	Manager string `yaml:"manager"`
+	Name    string `yaml:"name"`
+	Version string `yaml:"version,omitempty"`
+}
+
+// LockLink is a link as written in config.yml, so the lock doesn't depend on
+// the home directory, $ZETUP_DIR or hostname of the machine it was made on,
+// Hash is of what src is on this machine
+type LockLink struct {
+	Src    string `yaml:"src"`
+	Target string `yaml:"target"`
+	Hash   string `yaml:"hash"`
+}
+
+// a package or one of its subpackages
+type pkgScope struct {
+	Subpkg string
+	Dir    string
+	Viper  *viper.Viper
+	// system packages are only installed on linux
+	InstallPkgs bool
+}
+
+func listScopes() ([]pkgScope, error) {
+	scopes := []pkgScope{{
+		Dir:         usePkgDir,
+		Viper:       readPkgViper(usePkgDir),
+		InstallPkgs: runtime.GOOS == "linux",
+	}}
+	subpkgDirs, err := getActiveSubpkgs()
+	if err != nil {
+		return nil, err
+	}
+	for _, subpkgDir := range subpkgDirs {
+		scopes = append(scopes, pkgScope{
+			Subpkg:      path.Base(subpkgDir),
+			Dir:         subpkgDir,
+			Viper:       readPkgViper(subpkgDir),
+			InstallPkgs: runtime.GOOS == "linux",
+		})
+	}
+	return scopes, nil
+}
+
+func lockFile() string {
+	return path.Join(zetupDir, "zetup.lock")
+}
+
+// buildLock resolves usePkgDir, installed versions are only looked up when
+// withVersions is set
+func buildLock(withVersions bool) (Lock, error) {
+	lock := Lock{
+		Source: usePkgSource.String(),
+		Ref:    usePkgSource.Ref,
+		Commit: headCommit(usePkgDir),
+	}
+	for _, dep := range useDepends {
+		lock.Depends = append(lock.Depends, LockDepend{
+			Source: dep.String(),
+			Ref:    dep.Ref,
+			Commit: headCommit(dep.Dir()),
+		})
+	}
+	scopes, err := listScopes()
+	if err != nil {
+		return lock, err
+	}
+	seen := map[string]bool{}
+	for _, scope := range scopes {
+		if scope.Subpkg != "" {
+			rel, _ := filepath.Rel(usePkgDir, scope.Dir)
+			lock.Subpkgs = append(lock.Subpkgs, LockSubpkg{
+				Path: filepath.ToSlash(rel),
+				Hash: hashPath(scope.Dir),
+			})
+		}
+		if scope.InstallPkgs {
+			for _, manager := range usedPackageManagers() {
+				for _, name := range requestedPackages(scope.Viper, manager) {
+					if seen[manager.Name()+" "+name] {
+						continue
+					}
+					seen[manager.Name()+" "+name] = true
+					lockPkg := LockPackage{Manager: manager.Name(), Name: name}
+					if withVersions {
+						_, lockPkg.Version = manager.Installed(name)
+					}
+					lock.Packages = append(lock.Packages, lockPkg)
+				}
+			}
+		}
+		toLinkFiles, err := renderLinks(scope.Viper)
+		if err != nil {
+			return lock, err
+		}
+		for _, toLinkFile := range toLinkFiles {
+			lock.Links = append(lock.Links, LockLink{
+				Src:    toLinkFile.RawSrc,
+				Target: toLinkFile.RawTarget,
+				Hash:   hashPath(toLinkFile.Src),
+			})
+		}
+	}
+	return lock, nil
+}
+
+// lockedPkg pins pkg to the locked commit when no ref was given, so
+// `zetup use pkg --locked` reproduces the lock on a new machine
+func lockedPkg(pkg string) string {
+	source, err := parsePkgSource(pkg)
+	if err != nil || source.Ref != "" {
+		return pkg
+	}
+	locked, err := readLock()
+	if err != nil || locked.Source != source.String() || locked.Commit == "" {
+		return pkg
+	}
+	return pkg + "@" + locked.Commit
+}
+
+// ensureLocked refuses to continue if usePkgDir resolves differently from the lock
+func ensureLocked() {
+	locked, err := readLock()
+	if err != nil {
+		log.Fatalf("could not read %v: %v", lockFile(), err)
+	}
+	current, err := buildLock(false)
+	check(err)
+	diffs := lockDiff(locked, current)
+	if len(diffs) == 0 {
+		return
+	}
+	for _, diff := range diffs {
+		log.Println(diff)
+	}
+	log.Fatalf("%v does not match %v, run without --locked to update the lock", pkgKey(usePkgDir), lockFile())
+}
+
+func readLock() (Lock, error) {
+	var lock Lock
+	dat, err := ioutil.ReadFile(lockFile())
+	if err != nil {
+		return lock, err
+	}
+	err = yaml.Unmarshal(dat, &lock)
+	return lock, err
+}
+
+func writeLock() {
+	lock, err := buildLock(true)
+	check(err)
+	marshaled, err := yaml.Marshal(lock)
+	check(err)
+	withHeader := []byte("# generated file do not edit, written by `zetup use`\n" + string(marshaled))
+	err = ioutil.WriteFile(lockFile(), withHeader, 0644)
+	check(err)
+}
+
+// lockDiff lists everything that resolves differently from the lock,
+// installed versions are not compared since they depend on the machine
+func lockDiff(locked Lock, current Lock) []string {
+	var diffs []string
+	if locked.Source != current.Source {
+		diffs = append(diffs, fmt.Sprintf("source is %v, locked %v", current.Source, locked.Source))
+	}
+	if locked.Commit != current.Commit {
+		diffs = append(diffs, fmt.Sprintf("commit is %v, locked %v", current.Commit, locked.Commit))
+	}
+
+	lockedDepends := map[string]string{}
+	for _, dep := range locked.Depends {
+		lockedDepends[dep.Source] = dep.Commit
+	}
+	for _, dep := range current.Depends {
+		commit, ok := lockedDepends[dep.Source]
+		if !ok {
+			diffs = append(diffs, "dependency "+dep.Source+" is not in the lock")
+		} else if commit != dep.Commit {
+			diffs = append(diffs, fmt.Sprintf("dependency %v is at %v, locked %v", dep.Source, dep.Commit, commit))
+		}
+		delete(lockedDepends, dep.Source)
+	}
+	for _, source := range sortedKeys(lockedDepends) {
+		diffs = append(diffs, "dependency "+source+" is no longer needed")
+	}
+
+	lockedSubpkgs := map[string]string{}
+	for _, subpkg := range locked.Subpkgs {
+		lockedSubpkgs[subpkg.Path] = subpkg.Hash
+	}
+	for _, subpkg := range current.Subpkgs {
+		hash, ok := lockedSubpkgs[subpkg.Path]
+		if !ok {
+			diffs = append(diffs, "subpackage "+subpkg.Path+" is not in the lock")
+		} else if hash != subpkg.Hash {
+			diffs = append(diffs, "subpackage "+subpkg.Path+" changed")
+		}
+		delete(lockedSubpkgs, subpkg.Path)
+	}
+	for _, subpkgPath := range sortedKeys(lockedSubpkgs) {
+		diffs = append(diffs, "subpackage "+subpkgPath+" is missing")
+	}
+
+	lockedPkgs := map[string]string{}
+	for _, pkg := range locked.Packages {
+		lockedPkgs[pkg.Manager+" package "+pkg.Name] = pkg.Version
+	}
+	for _, pkg := range current.Packages {
+		key := pkg.Manager + " package " + pkg.Name
+		if _, ok := lockedPkgs[key]; !ok {
+			diffs = append(diffs, key+" is not in the lock")
+		}
+		delete(lockedPkgs, key)
+	}
+	for _, key := range sortedKeys(lockedPkgs) {
+		diffs = append(diffs, key+" is no longer requested")
+	}
+
+	lockedLinks := map[string]string{}
+	for _, link := range locked.Links {
+		lockedLinks[link.Target] = link.Src + " " + link.Hash
+	}
+	for _, link := range current.Links {
+		lockedLink, ok := lockedLinks[link.Target]
+		if !ok {
+			diffs = append(diffs, "link "+link.Target+" is not in the lock")
+		} else if lockedLink != link.Src+" "+link.Hash {
+			diffs = append(diffs, "link "+link.Target+" changed")
+		}
+		delete(lockedLinks, link.Target)
+	}
+	for _, target := range sortedKeys(lockedLinks) {
+		diffs = append(diffs, "link "+target+" is missing")
+	}
+	return diffs
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hashPath hashes a file, or every file in a directory except .git
+func hashPath(p string) string {
+	hash := sha256.New()
+	err := filepath.Walk(p, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(p, file)
+		fmt.Fprintf(hash, "%v\n", filepath.ToSlash(rel))
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(hash, f)
+		return err
+	})
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
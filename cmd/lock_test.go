@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLockDiff(t *testing.T) {
+	locked := Lock{
+		Source: "github.com/me/dotfiles",
+		Commit: "aaa",
+		Depends: []LockDepend{
+			{Source: "github.com/me/base", Commit: "bbb"},
+			{Source: "github.com/me/old", Commit: "ccc"},
+		},
+		Subpkgs: []LockSubpkg{
+			{Path: "subpkg/vim", Hash: "v1"},
+			{Path: "subpkg/gone", Hash: "g1"},
+		},
+		Packages: []LockPackage{
+			{Manager: "apt", Name: "tmux", Version: "2.6"},
+			{Manager: "apt", Name: "emacs", Version: "25"},
+		},
+		Links: []LockLink{
+			{Src: "{{.PkgDir}}/bashrc", Target: "{{.Home}}/.bashrc", Hash: "b1"},
+			{Src: "{{.PkgDir}}/vimrc", Target: "{{.Home}}/.vimrc", Hash: "v1"},
+			{Src: "{{.PkgDir}}/emacs", Target: "{{.Home}}/.emacs", Hash: "e1"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		current func(lock Lock) Lock
+		diffs   []string
+	}{
+		{
+			name:    "same",
+			current: func(lock Lock) Lock { return lock },
+		},
+		{
+			name: "source and commit",
+			current: func(lock Lock) Lock {
+				lock.Source = "github.com/you/dotfiles"
+				lock.Commit = "ddd"
+				return lock
+			},
+			diffs: []string{
+				"source is github.com/you/dotfiles, locked github.com/me/dotfiles",
+				"commit is ddd, locked aaa",
+			},
+		},
+		{
+			name: "dependencies",
+			current: func(lock Lock) Lock {
+				lock.Depends = []LockDepend{
+					{Source: "github.com/me/base", Commit: "eee"},
+					{Source: "github.com/me/new", Commit: "fff"},
+				}
+				return lock
+			},
+			diffs: []string{
+				"dependency github.com/me/base is at eee, locked bbb",
+				"dependency github.com/me/new is not in the lock",
+				"dependency github.com/me/old is no longer needed",
+			},
+		},
+		{
+			name: "subpackages",
+			current: func(lock Lock) Lock {
+				lock.Subpkgs = []LockSubpkg{
+					{Path: "subpkg/vim", Hash: "v2"},
+					{Path: "subpkg/new", Hash: "n1"},
+				}
+				return lock
+			},
+			diffs: []string{
+				"subpackage subpkg/vim changed",
+				"subpackage subpkg/new is not in the lock",
+				"subpackage subpkg/gone is missing",
+			},
+		},
+		{
+			name: "packages, versions are not compared",
+			current: func(lock Lock) Lock {
+				lock.Packages = []LockPackage{
+					{Manager: "apt", Name: "tmux", Version: "3.0"},
+					{Manager: "snap", Name: "code"},
+				}
+				return lock
+			},
+			diffs: []string{
+				"snap package code is not in the lock",
+				"apt package emacs is no longer requested",
+			},
+		},
+		{
+			name: "links",
+			current: func(lock Lock) Lock {
+				lock.Links = []LockLink{
+					{Src: "{{.PkgDir}}/bashrc", Target: "{{.Home}}/.bashrc", Hash: "b2"},
+					{Src: "{{.PkgDir}}/vimrc-new", Target: "{{.Home}}/.vimrc", Hash: "v1"},
+					{Src: "{{.PkgDir}}/tmux.conf", Target: "{{.Home}}/.tmux.conf", Hash: "t1"},
+				}
+				return lock
+			},
+			diffs: []string{
+				"link {{.Home}}/.bashrc changed",
+				"link {{.Home}}/.vimrc changed",
+				"link {{.Home}}/.tmux.conf is not in the lock",
+				"link {{.Home}}/.emacs is missing",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		diffs := lockDiff(locked, test.current(locked))
+		if !reflect.DeepEqual(diffs, test.diffs) {
+			t.Errorf("%v: got %q, want %q", test.name, diffs, test.diffs)
+		}
+	}
+}
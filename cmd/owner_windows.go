@@ -0,0 +1,8 @@
+package cmd
+
+import "os"
+
+// windows has no uids, files are restored as the current user
+func fileOwner(info os.FileInfo) (int, int) {
+	return os.Getuid(), os.Getgid()
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// packagesCmd represents the packages command
+var packagesCmd = &cobra.Command{
+	Use:   "packages",
+	Short: "show and fix the system packages zetup knows about",
+	Long: `zetup records every system package a zetup package asks for in
+installed-<manager> in its config, along with whether zetup installed it or
+it was already there, and which packages and subpackages need it. Only
+packages zetup installed are ever removed, by "zetup unuse --purge-packages".`,
+}
+
+var packagesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list recorded packages and whether they are still installed",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		found := false
+		for _, manager := range usedPackageManagers() {
+			for _, pkg := range recordedPackages(manager) {
+				found = true
+				version := "not installed"
+				if ok, installedVersion := manager.Installed(pkg); ok {
+					version = installedVersion
+				}
+				record := packageRecord(manager, pkg)
+				fmt.Printf("%-6v %-24v %-7v %-16v %v\n", manager.Name(), pkg, record.By, version,
+					strings.Join(record.NeededBy, ", "))
+			}
+		}
+		if !found {
+			fmt.Println("no packages recorded")
+		}
+	},
+}
+
+var packagesSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "rebuild the recorded packages from what is installed",
+	Long: `Forgets recorded packages that were removed outside of zetup, and records
+the packages the package in use asks for that are installed but were not
+recorded, as installed by the system. Packages asked for by the package in
+use are recorded as needed by it.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		changed := false
+		for _, manager := range usedPackageManagers() {
+			for _, pkg := range recordedPackages(manager) {
+				if ok, _ := manager.Installed(pkg); !ok {
+					fmt.Printf("forgot %v %v, it is not installed anymore\n", manager.Name(), pkg)
+					recordInstalled(manager, pkg, "", "")
+					changed = true
+				}
+			}
+		}
+
+		usePkgDir = mainViper.GetString("use-pkg")
+		if usePkgDir != "" && runtime.GOOS == "linux" {
+			scopes, err := listScopes()
+			check(err)
+			for _, scope := range scopes {
+				for _, manager := range usedPackageManagers() {
+					for _, pkg := range requestedPackages(scope.Viper, manager) {
+						if ok, _ := manager.Installed(pkg); !ok {
+							continue
+						}
+						by := installedBy(manager, pkg)
+						if by == "" {
+							fmt.Printf("recorded %v %v, it was already installed\n", manager.Name(), pkg)
+							by = "system"
+						}
+						if !containsString(packageRecord(manager, pkg).NeededBy, backupScope(scope.Subpkg)) {
+							recordInstalled(manager, pkg, by, backupScope(scope.Subpkg))
+							changed = true
+						}
+					}
+				}
+			}
+		}
+
+		if !changed {
+			fmt.Println("already in sync")
+			return
+		}
+		err := mainViper.WriteConfig()
+		check(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(packagesCmd)
+	packagesCmd.AddCommand(packagesListCmd)
+	packagesCmd.AddCommand(packagesSyncCmd)
+}
@@ -0,0 +1,550 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// PackageManager installs, queries and removes system packages
+type PackageManager interface {
+	Name() string
+	// Installed reports whether pkg is installed and which version
+	Installed(pkg string) (bool, string)
+	Install(pkgs []string) error
+	Remove(pkgs []string) error
+}
+
+// cmdPackageManager drives a package manager through its command line,
+// install and remove run with sudo
+type cmdPackageManager struct {
+	name string
+	// run once before installing, can be empty
+	update  []string
+	install []string
+	remove  []string
+	// install one package per command, like snap --classic
+	onePerCmd bool
+	query     func(pkg string) (bool, string)
+}
+
+func (m cmdPackageManager) Name() string {
+	return m.name
+}
+
+func (m cmdPackageManager) Installed(pkg string) (bool, string) {
+	return m.query(pkg)
+}
+
+func (m cmdPackageManager) Install(pkgs []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+	if len(m.update) > 0 {
+		if mainViper.GetBool("verbose") {
+			log.Printf("updating %v\n", m.name)
+		}
+		if err := runSudo(m.update...); err != nil {
+			return fmt.Errorf("Could not run %v: %v", strings.Join(m.update, " "), err)
+		}
+	}
+	if mainViper.GetBool("verbose") {
+		log.Printf("installing %+v using %v\n", pkgs, m.name)
+	}
+	return m.run(m.install, pkgs)
+}
+
+func (m cmdPackageManager) Remove(pkgs []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+	if mainViper.GetBool("verbose") {
+		log.Printf("removing %+v using %v\n", pkgs, m.name)
+	}
+	return m.run(m.remove, pkgs)
+}
+
+func (m cmdPackageManager) run(cmd []string, pkgs []string) error {
+	batches := [][]string{pkgs}
+	if m.onePerCmd {
+		batches = nil
+		for _, pkg := range pkgs {
+			batches = append(batches, []string{pkg})
+		}
+	}
+	for _, batch := range batches {
+		cmdArgs := append(append([]string{}, cmd...), batch...)
+		if err := runSudo(cmdArgs...); err != nil {
+			return fmt.Errorf("Could not run %v: %v", strings.Join(cmdArgs, " "), err)
+		}
+	}
+	return nil
+}
+
+func queryDpkg(pkg string) (bool, string) {
+	out, err := exec.Command("dpkg-query", "-W", "-f=${Status} ${Version}", pkg).Output()
+	if err != nil {
+		return false, ""
+	}
+	// install ok installed 1:8.0.1453-1ubuntu1
+	fields := strings.Fields(string(out))
+	if len(fields) < 4 || fields[2] != "installed" {
+		return false, ""
+	}
+	return true, fields[3]
+}
+
+func queryRpm(pkg string) (bool, string) {
+	out, err := exec.Command("rpm", "-q", "--qf", "%{VERSION}-%{RELEASE}", pkg).Output()
+	if err != nil {
+		return false, ""
+	}
+	return true, strings.TrimSpace(string(out))
+}
+
+func queryPacman(pkg string) (bool, string) {
+	// vim 8.1.1234-1
+	out, err := exec.Command("pacman", "-Q", pkg).Output()
+	if err != nil {
+		return false, ""
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return true, ""
+	}
+	return true, fields[1]
+}
+
+func queryApk(pkg string) (bool, string) {
+	// vim-8.1.1365-r0
+	out, err := exec.Command("apk", "info", "-e", "-v", pkg).Output()
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		return false, ""
+	}
+	return true, strings.TrimPrefix(strings.TrimSpace(string(out)), pkg+"-")
+}
+
+func querySnap(pkg string) (bool, string) {
+	// Name  Version  Rev  Tracking  Publisher  Notes
+	out, err := exec.Command("snap", "list", pkg).Output()
+	if err != nil {
+		return false, ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 2 {
+		return true, ""
+	}
+	return true, fields[1]
+}
+
+// packageManagers are all supported backends, the key is also the key
+// used in config.yml and in installed-<name> in the zetup config
+var packageManagers = map[string]PackageManager{
+	"apt": cmdPackageManager{
+		name:    "apt",
+		update:  []string{"apt-get", "update", "-yqq"},
+		install: []string{"apt-get", "install", "-yqq"},
+		remove:  []string{"apt-get", "remove", "-yqq"},
+		query:   queryDpkg,
+	},
+	"dnf": cmdPackageManager{
+		name:    "dnf",
+		install: []string{"dnf", "install", "-y"},
+		remove:  []string{"dnf", "remove", "-y"},
+		query:   queryRpm,
+	},
+	"yum": cmdPackageManager{
+		name:    "yum",
+		install: []string{"yum", "install", "-y"},
+		remove:  []string{"yum", "remove", "-y"},
+		query:   queryRpm,
+	},
+	"pacman": cmdPackageManager{
+		name:    "pacman",
+		install: []string{"pacman", "-S", "--noconfirm", "--needed"},
+		remove:  []string{"pacman", "-R", "--noconfirm"},
+		query:   queryPacman,
+	},
+	"zypper": cmdPackageManager{
+		name:    "zypper",
+		install: []string{"zypper", "--non-interactive", "install"},
+		remove:  []string{"zypper", "--non-interactive", "remove"},
+		query:   queryRpm,
+	},
+	"apk": cmdPackageManager{
+		name:    "apk",
+		update:  []string{"apk", "update"},
+		install: []string{"apk", "add"},
+		remove:  []string{"apk", "del"},
+		query:   queryApk,
+	},
+	"snap": cmdPackageManager{
+		name:      "snap",
+		install:   []string{"snap", "install", "--classic"},
+		remove:    []string{"snap", "remove"},
+		onePerCmd: true,
+		query:     querySnap,
+	},
+}
+
+// distroFamilies maps distro ids to the package manager of the family
+var distroFamilies = map[string]string{
+	"debian":    "apt",
+	"ubuntu":    "apt",
+	"linuxmint": "apt",
+	"pop":       "apt",
+	"raspbian":  "apt",
+	"fedora":    "dnf",
+	"rhel":      "dnf",
+	"centos":    "dnf",
+	"rocky":     "dnf",
+	"almalinux": "dnf",
+	"arch":      "pacman",
+	"manjaro":   "pacman",
+	"opensuse":  "zypper",
+	"suse":      "zypper",
+	"sles":      "zypper",
+	"alpine":    "apk",
+}
+
+// systemPackageManager picks the backend for the distro family, or nil
+func systemPackageManager() PackageManager {
+	var name string
+	for _, id := range append([]string{getFacts().ID}, getFacts().IDLike...) {
+		if family, ok := distroFamilies[id]; ok {
+			name = family
+			break
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	// older centos and rhel only have yum
+	if name == "dnf" && !hasCommand("dnf") && hasCommand("yum") {
+		name = "yum"
+	}
+	return packageManagers[name]
+}
+
+// usedPackageManagers are the system package manager and snap, snap is
+// used on debian based distros (apt installs snapd) or when it is installed
+func usedPackageManagers() []PackageManager {
+	var managers []PackageManager
+	system := systemPackageManager()
+	if system != nil {
+		managers = append(managers, system)
+	}
+	if (system != nil && system.Name() == "apt") || hasCommand("snap") {
+		managers = append(managers, packageManagers["snap"])
+	}
+	return managers
+}
+
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// requestedPackages lists the packages vip asks manager to install, the
+// system package manager also gets the cross distro `packages` list
+//
+//	packages:
+//	  - git
+//	  - name: fd
+//	    apt: fd-find
+//	    dnf: fd-find
+func requestedPackages(vip *viper.Viper, manager PackageManager) []string {
+	pkgs := vip.GetStringSlice(manager.Name())
+	if manager.Name() == "snap" {
+		return pkgs
+	}
+	crossDistro, _ := vip.Get("packages").([]interface{})
+	for _, entry := range crossDistro {
+		switch entry := entry.(type) {
+		case string:
+			pkgs = append(pkgs, entry)
+		case map[interface{}]interface{}:
+			name, ok := entry[manager.Name()]
+			if !ok {
+				name = entry["name"]
+			}
+			if nameStr, _ := name.(string); nameStr != "" {
+				pkgs = append(pkgs, nameStr)
+			}
+		}
+	}
+	return pkgs
+}
+
+// PackageRecord is what installed-<manager>.<pkg> in the zetup config says
+// about a system package
+//
+//	installed-apt:
+//	  vim:
+//	    by: zetup
+//	    needed-by:
+//	    - github.com/zetup-sh/zetup-pkg/main
+type PackageRecord struct {
+	// By is zetup or system, or "" if pkg is not recorded
+	By string
+	// NeededBy are the scopes, like backupScope, that asked for pkg
+	NeededBy []string
+	// legacy records are only true, zetup did not know who needed them
+	legacy bool
+}
+
+// packageRecords is installed-<manager> as it would be written, Get only
+// returns what was Set for a nested key and not what was read from the file
+func packageRecords(manager PackageManager) map[string]interface{} {
+	records, _ := mainViper.AllSettings()["installed-"+manager.Name()].(map[string]interface{})
+	if records == nil {
+		records = map[string]interface{}{}
+	}
+	return records
+}
+
+func packageRecord(manager PackageManager, pkg string) PackageRecord {
+	switch value := packageRecords(manager)[pkg].(type) {
+	case bool:
+		// recorded before zetup told them apart
+		if value {
+			return PackageRecord{By: "zetup", legacy: true}
+		}
+	case map[string]interface{}:
+		return parsePackageRecord(value["by"], value["needed-by"])
+	case map[interface{}]interface{}:
+		return parsePackageRecord(value["by"], value["needed-by"])
+	}
+	return PackageRecord{}
+}
+
+func parsePackageRecord(by interface{}, neededBy interface{}) PackageRecord {
+	record := PackageRecord{}
+	record.By, _ = by.(string)
+	switch neededBy := neededBy.(type) {
+	case []string:
+		record.NeededBy = append(record.NeededBy, neededBy...)
+	case []interface{}:
+		for _, scope := range neededBy {
+			if scopeStr, ok := scope.(string); ok {
+				record.NeededBy = append(record.NeededBy, scopeStr)
+			}
+		}
+	}
+	return record
+}
+
+// writePackageRecord stores record, a record without By forgets pkg
+func writePackageRecord(manager PackageManager, pkg string, record PackageRecord) {
+	records := packageRecords(manager)
+	if record.By == "" {
+		delete(records, pkg)
+		mainViper.Set("installed-"+manager.Name(), records)
+		// the record is still in the config file viper read
+		forgetConfigSetting("installed-"+manager.Name(), pkg)
+		return
+	}
+	neededBy := record.NeededBy
+	if neededBy == nil {
+		neededBy = []string{}
+	}
+	records[pkg] = map[string]interface{}{"by": record.By, "needed-by": neededBy}
+	mainViper.Set("installed-"+manager.Name(), records)
+}
+
+// forgetConfigSetting removes key from the map setting parent of mainViper.
+// viper can't unset a key that is in the config file, so the config it read
+// is replaced with the current settings without it
+func forgetConfigSetting(parent string, key string) {
+	settings := mainViper.AllSettings()
+	if values, ok := settings[parent].(map[string]interface{}); ok {
+		delete(values, key)
+	}
+	out, err := yaml.Marshal(settings)
+	check(err)
+	mainViper.SetConfigType("yaml")
+	err = mainViper.ReadConfig(bytes.NewReader(out))
+	check(err)
+}
+
+// installedBy is who installed pkg, zetup, system or "" if it is not recorded
+func installedBy(manager PackageManager, pkg string) string {
+	return packageRecord(manager, pkg).By
+}
+
+// recordInstalled sets who installed pkg and adds scope to the scopes that
+// need it, by "" forgets pkg
+func recordInstalled(manager PackageManager, pkg string, by string, scope string) {
+	record := packageRecord(manager, pkg)
+	if by == "" {
+		writePackageRecord(manager, pkg, PackageRecord{})
+		return
+	}
+	record.By = by
+	if scope != "" && !containsString(record.NeededBy, scope) {
+		record.NeededBy = append(record.NeededBy, scope)
+	}
+	writePackageRecord(manager, pkg, record)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedPackages lists the packages recorded in installed-<manager>, sorted
+func recordedPackages(manager PackageManager) []string {
+	var pkgs []string
+	for pkg := range packageRecords(manager) {
+		if installedBy(manager, pkg) != "" {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// packagesToInstall asks the package manager which of pkgs are missing,
+// onSystem are installed but not recorded yet, so zetup did not install them
+func packagesToInstall(manager PackageManager, pkgs []string) (toInstall []string, onSystem []string) {
+	for _, pkg := range pkgs {
+		if ok, _ := manager.Installed(pkg); !ok {
+			toInstall = append(toInstall, pkg)
+		} else if installedBy(manager, pkg) == "" {
+			onSystem = append(onSystem, pkg)
+		}
+	}
+	return toInstall, onSystem
+}
+
+// ensurePackages installs whatever vip requests that is not installed yet
+// and records that scope needs it
+func ensurePackages(vip *viper.Viper, scope string) error {
+	for _, manager := range usedPackageManagers() {
+		requested := requestedPackages(vip, manager)
+		toInstall, _ := packagesToInstall(manager, requested)
+		// journaled first, so a failed or interrupted install is removed too
+		if len(toInstall) > 0 {
+			journalRecord(JournalEntry{Action: manager.Name() + "-install", Args: toInstall})
+		}
+		if err := manager.Install(toInstall); err != nil {
+			return err
+		}
+		for _, pkg := range requested {
+			by := installedBy(manager, pkg)
+			if containsString(toInstall, pkg) {
+				by = "zetup"
+			} else if by == "" {
+				by = "system"
+			}
+			recordInstalled(manager, pkg, by, scope)
+		}
+		if len(requested) > 0 {
+			mainViper.WriteConfig()
+		}
+	}
+	return nil
+}
+
+// journalRecordPackages snapshots the package records before a scope releases
+// its packages
+func journalRecordPackages() {
+	for _, manager := range usedPackageManagers() {
+		marshaled, err := yaml.Marshal(packageRecords(manager))
+		check(err)
+		journalRecord(JournalEntry{Action: "package-records", Scope: manager.Name(), Args: []string{string(marshaled)}})
+	}
+}
+
+// releasePackages drops scope from the scopes that need each recorded
+// package, with purge the packages zetup installed that nothing needs
+// anymore are removed, vip is the config of scope
+func releasePackages(vip *viper.Viper, scope string, purge bool) error {
+	for _, manager := range usedPackageManagers() {
+		requested := requestedPackages(vip, manager)
+		var toRemove []string
+		for _, pkg := range recordedPackages(manager) {
+			record := packageRecord(manager, pkg)
+			if record.legacy {
+				// legacy records don't know who needs them, so the scopes of
+				// the package in use that ask for pkg do
+				if !containsString(requested, pkg) {
+					continue
+				}
+				record.NeededBy = legacyNeededBy(manager, pkg)
+				if !containsString(record.NeededBy, scope) {
+					record.NeededBy = append(record.NeededBy, scope)
+				}
+			}
+			if !containsString(record.NeededBy, scope) {
+				continue
+			}
+			var neededBy []string
+			for _, other := range record.NeededBy {
+				if other != scope {
+					neededBy = append(neededBy, other)
+				}
+			}
+			record.NeededBy = neededBy
+			switch {
+			case len(neededBy) > 0:
+				if purge && record.By == "zetup" {
+					log.Printf("keeping %v, %v still needs it\n", pkg, strings.Join(neededBy, ", "))
+				}
+				writePackageRecord(manager, pkg, record)
+			case purge && record.By == "zetup":
+				toRemove = append(toRemove, pkg)
+			case record.By == "system":
+				writePackageRecord(manager, pkg, PackageRecord{})
+			default:
+				writePackageRecord(manager, pkg, record)
+			}
+		}
+		if err := manager.Remove(toRemove); err != nil {
+			mainViper.WriteConfig()
+			return err
+		}
+		for _, pkg := range toRemove {
+			recordInstalled(manager, pkg, "", "")
+		}
+		mainViper.WriteConfig()
+	}
+	return nil
+}
+
+// legacyNeededBy are the scopes of the package in use whose config asks for pkg
+func legacyNeededBy(manager PackageManager, pkg string) []string {
+	var neededBy []string
+	scopes, err := listScopes()
+	if err != nil {
+		return nil
+	}
+	for _, scope := range scopes {
+		if containsString(requestedPackages(scope.Viper, manager), pkg) {
+			neededBy = append(neededBy, backupScope(scope.Subpkg))
+		}
+	}
+	return neededBy
+}
+
+func warnNoPackageManager(vip *viper.Viper) {
+	if systemPackageManager() != nil {
+		return
+	}
+	for name := range packageManagers {
+		if len(vip.GetStringSlice(name)) > 0 && name != "snap" {
+			log.Printf("no supported package manager for %v, skipping %v packages\n", getFacts().ID, name)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestForgetPackage(t *testing.T) {
+	oldViper := mainViper
+	defer func() {
+		mainViper = oldViper
+	}()
+	dir, err := ioutil.TempDir("", "zetup-pkgmgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := path.Join(dir, "config.yml")
+	config := `installed-apt:
+  tmux:
+    by: zetup
+    needed-by: [github.com/me/dotfiles/main]
+  vim:
+    by: zetup
+    needed-by: [github.com/me/dotfiles/subpkg/vim]
+github-username: me
+`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mainViper = viper.New()
+	mainViper.SetConfigFile(configFile)
+	if err := mainViper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	apt := packageManagers["apt"]
+	recordInstalled(apt, "tmux", "", "")
+	recordInstalled(apt, "vim", "", "")
+	recordInstalled(apt, "git", "zetup", "github.com/me/dotfiles/main")
+	if err := mainViper.WriteConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := recordedPackages(apt); strings.Join(got, " ") != "git" {
+		t.Errorf("recorded packages are %v, want [git]", got)
+	}
+	if _, ok := packageRecords(apt)["tmux"]; ok {
+		t.Errorf("tmux is still in the records")
+	}
+	out, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "tmux") || strings.Contains(string(out), "vim") {
+		t.Errorf("forgotten packages are still in the config:\n%s", out)
+	}
+	if !strings.Contains(string(out), "github-username: me") {
+		t.Errorf("the rest of the config is gone:\n%s", out)
+	}
+}
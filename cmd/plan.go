@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Plan is everything `zetup use` would do, without doing it
+type Plan struct {
+	Pkg     string       `json:"pkg"`
+	PkgDir  string       `json:"pkgDir"`
+	Commit  string       `json:"commit"`
+	Actions []PlanAction `json:"actions"`
+}
+
+type PlanAction struct {
+	Scope    string   `json:"scope"`
+	Action   string   `json:"action"`
+	Packages []string `json:"packages,omitempty"`
+	Src      string   `json:"src,omitempty"`
+	Target   string   `json:"target,omitempty"`
+	Mode     string   `json:"mode,omitempty"`
+	Backup   string   `json:"backup,omitempty"`
+	Contents string   `json:"contents,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+}
+
+// planCmd represents the plan command
+var planCmd = &cobra.Command{
+	Use:   "plan <pkg>",
+	Short: "show what `zetup use` would do",
+	Long: `Resolves a package, the packages it depends on and their subpackages and
+prints every action "zetup use" would take without running any of them. The
+packages are cloned into $ZETUP_DIR/pkg if they aren't there already, clones
+that are there are left as they are, the plan is for what they have checked
+out.
+
+Same as "zetup use --dry-run".`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: map[string]string{"dry-run": "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		pkgToInstall = args[0]
+		ensureRepo()
+		printPlan(buildPlan())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+	planCmd.Flags().StringVarP(&outputFormat, "output", "o", "text",
+		"output format, text or json")
+}
+
+func buildPlan() Plan {
+	plan := Plan{
+		Pkg:    pkgToInstall,
+		PkgDir: usePkgDir,
+		Commit: headCommit(usePkgDir),
+	}
+
+	// mirror the order of usePkg
+	// "<manager> <package>" of packages planned by an earlier scope
+	plannedPkgs := map[string]bool{}
+	for _, dep := range useDepends {
+		_ = withPkg(dep, func() error {
+			plan.Actions = append(plan.Actions, planPkg(pkgKey(usePkgDir)+" ", plannedPkgs)...)
+			return nil
+		})
+	}
+	plan.Actions = append(plan.Actions, planPkg("", plannedPkgs)...)
+
+	if mainViper.GetString("use-pkg") != usePkgDir {
+		plan.Actions = append(plan.Actions, PlanAction{
+			Scope:  "main",
+			Action: "use-pkg",
+			Target: usePkgDir,
+		})
+	}
+
+	home, _ := homedir.Dir()
+	gitConfigPath := path.Join(home, ".gitconfig")
+	current, _ := ioutil.ReadFile(gitConfigPath)
+	if string(current) != gitConfig() {
+		plan.Actions = append(plan.Actions, PlanAction{
+			Scope:    "zetup",
+			Action:   "gitconfig",
+			Target:   gitConfigPath,
+			Contents: gitConfig(),
+		})
+	}
+	return plan
+}
+
+// planPkg plans usePkgDir and its subpackages, prefix is put before the
+// scope of every action
+func planPkg(prefix string, plannedPkgs map[string]bool) []PlanAction {
+	mainPkgViper := readPkgViper(usePkgDir)
+	installPkgs := runtime.GOOS == "linux"
+	actions := planScope(prefix+"main", usePkgDir, mainPkgViper, mainViper, installPkgs, plannedPkgs)
+	mainPostUse := planHook(prefix+"main", usePkgDir, "post-use", mainViper)
+
+	subpkgDirs, err := getListOfSubpkgs()
+	check(err)
+	for _, subpkgDir := range subpkgDirs {
+		subpkgViper := readPkgViper(subpkgDir)
+		scope := prefix + "subpkg " + path.Base(subpkgDir)
+		if active, reason := subpkgActive(subpkgDir, subpkgViper); !active {
+			if subpkgApplied(path.Base(subpkgDir)) {
+				actions = append(actions, PlanAction{Scope: scope, Action: "unuse", Src: subpkgDir, Reason: reason})
+			}
+			continue
+		}
+		actions = append(actions, planScope(scope, subpkgDir, subpkgViper, subpkgViper, true, plannedPkgs)...)
+		actions = append(actions, planHook(scope, subpkgDir, "post-use", subpkgViper)...)
+	}
+	return append(actions, mainPostUse...)
+}
+
+// planHook plans running the hook of dir, if it has one
+func planHook(scope string, dir string, hook string, scriptViper *viper.Viper) []PlanAction {
+	hookFile, err := FindFile(dir, hook, runtime.GOOS, LINUX_EXTENSIONS, scriptViper)
+	if err != nil {
+		return nil
+	}
+	return []PlanAction{{Scope: scope, Action: "run-script", Src: hookFile}}
+}
+
+// scriptViper is where FindFile looks up custom script names, usePkg passes
+// mainViper for the main package
+func planScope(scope string, dir string, vip *viper.Viper, scriptViper *viper.Viper, installPkgs bool, plannedPkgs map[string]bool) []PlanAction {
+	var actions []PlanAction
+	if installPkgs {
+		for _, manager := range usedPackageManagers() {
+			toInstall, _ := packagesToInstall(manager, requestedPackages(vip, manager))
+			var pkgs []string
+			for _, pkg := range toInstall {
+				if !plannedPkgs[manager.Name()+" "+pkg] {
+					plannedPkgs[manager.Name()+" "+pkg] = true
+					pkgs = append(pkgs, pkg)
+				}
+			}
+			if len(pkgs) > 0 {
+				actions = append(actions, PlanAction{Scope: scope, Action: manager.Name() + "-install", Packages: pkgs})
+			}
+		}
+	}
+
+	actions = append(actions, planHook(scope, dir, "pre-use", scriptViper)...)
+	useFile, err := FindFile(dir, "use", runtime.GOOS, LINUX_EXTENSIONS, scriptViper)
+	if err == nil {
+		actions = append(actions, PlanAction{Scope: scope, Action: "run-script", Src: useFile})
+	}
+
+	toLinkFiles, err := renderLinks(vip)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tplInfo := newTplInfo(vip)
+	for _, toLinkFile := range toLinkFiles {
+		action := PlanAction{
+			Scope:  scope,
+			Action: "link",
+			Src:    toLinkFile.Src,
+			Target: toLinkFile.Target,
+			Mode:   toLinkFile.Mode,
+		}
+		var rendered string
+		if toLinkFile.Mode == "template" {
+			action.Action = "template"
+			rendered, err = renderTemplateFile(toLinkFile.Src, tplInfo)
+			if err != nil {
+				log.Fatal(err)
+			}
+			action.Contents = rendered
+		}
+		action.Backup = backupDecision(toLinkFile, rendered)
+		actions = append(actions, action)
+	}
+	actions = append(actions, planHook(scope, dir, "post-link", scriptViper)...)
+
+	files, _ := ioutil.ReadDir(path.Join(dir, "rc"))
+	for _, file := range files {
+		if !file.IsDir() {
+			actions = append(actions, PlanAction{
+				Scope:  scope,
+				Action: "rc",
+				Src:    path.Join(dir, "rc", file.Name()),
+			})
+		}
+	}
+	return actions
+}
+
+func backupDecision(toLinkFile ToLink, rendered string) string {
+	if linkInPlace(toLinkFile, rendered) {
+		if toLinkFile.Mode == "symlink" || toLinkFile.Mode == "relative" {
+			return "already linked"
+		}
+		return "up to date"
+	}
+	_, err := os.Lstat(toLinkFile.Target)
+	if os.IsNotExist(err) {
+		return "nothing to back up"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "back up existing file"
+}
+
+func printPlan(plan Plan) {
+	if outputFormat == "json" {
+		out, err := json.MarshalIndent(plan, "", "  ")
+		check(err)
+		fmt.Println(string(out))
+		return
+	}
+
+	fmt.Printf("plan for %v at %v (%v)\n", plan.Pkg, plan.Commit, plan.PkgDir)
+	if len(plan.Actions) == 0 {
+		fmt.Println("nothing to do")
+		return
+	}
+	scope := ""
+	for _, action := range plan.Actions {
+		if action.Scope != scope {
+			scope = action.Scope
+			fmt.Printf("\n%v:\n", scope)
+		}
+		fmt.Printf("  %v\n", describePlanAction(action))
+	}
+}
+
+func describePlanAction(action PlanAction) string {
+	if strings.HasSuffix(action.Action, "-install") {
+		return fmt.Sprintf("install %v packages: %v", strings.TrimSuffix(action.Action, "-install"), strings.Join(action.Packages, ", "))
+	}
+	switch action.Action {
+	case "run-script":
+		return "run " + action.Src
+	case "unuse":
+		return "undo, " + action.Reason
+	case "link":
+		return fmt.Sprintf("%v %v -> %v (%v)", action.Mode, action.Target, action.Src, action.Backup)
+	case "template":
+		return fmt.Sprintf("render %v into %v (%v)", action.Src, action.Target, action.Backup)
+	case "rc":
+		return "register rc fragment " + action.Src
+	case "use-pkg":
+		return "set use-pkg to " + action.Target
+	case "gitconfig":
+		return "write " + action.Target + ":\n    " +
+			strings.Replace(strings.TrimSpace(action.Contents), "\n", "\n    ", -1)
+	}
+	return action.Action
+}
@@ -17,35 +17,325 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
 )
 
+// fragments without a numeric prefix are sourced in the middle
+const defaultRcOrder = 50
+
+var rcOrder int
+
+// RcFragment is a shell file sourced by the generated rc loader
+type RcFragment struct {
+	Name     string `yaml:"name"`
+	Order    int    `yaml:"order"`
+	Package  string `yaml:"package,omitempty"`
+	Subpkg   string `yaml:"subpkg,omitempty"`
+	Path     string `yaml:"path"`
+	Disabled bool   `yaml:"disabled,omitempty"`
+}
+
 // rcCmd represents the rc command
 var rcCmd = &cobra.Command{
 	Use:   "rc",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "manage shell rc fragments",
+	Long: `Manage named shell fragments in $ZETUP_DIR/rc.
+
+Fragments are sourced by a generated loader, ordered by their numeric prefix,
+then by package, then by subpackage. Packages and subpackages can ship an rc/
+directory whose files are registered when the package is used.
+
+Running "zetup rc" by itself prints the line to add to your .bashrc.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		writeRcLoader(readRcIndex())
+		fmt.Println("# add this line to your .bashrc")
+		fmt.Println(rcSourceLine())
+	},
+}
+
+var rcAddCmd = &cobra.Command{
+	Use:   "add <name> [file]",
+	Short: "add a fragment from a file or stdin",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		if strings.ContainsAny(name, `/\ `) {
+			log.Fatal("fragment names must not contain slashes or spaces")
+		}
+		var dat []byte
+		var err error
+		if len(args) == 1 || args[1] == "-" {
+			dat, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			dat, err = ioutil.ReadFile(args[1])
+		}
+		check(err)
+
+		fragmentDir := path.Join(rcDir, "fragments")
+		err = os.MkdirAll(fragmentDir, 0755)
+		check(err)
+		fragmentFile := path.Join(fragmentDir, name+".sh")
+		err = ioutil.WriteFile(fragmentFile, dat, 0644)
+		check(err)
+
+		order := rcOrder
+		if !cmd.Flags().Changed("order") {
+			order = rcOrderFromName(name)
+		}
+		fragments := readRcIndex()
+		fragments = removeRcFragments(fragments, func(f RcFragment) bool {
+			return f.Name == name
+		})
+		fragments = append(fragments, RcFragment{
+			Name:  name,
+			Order: order,
+			Path:  fragmentFile,
+		})
+		writeRcIndex(fragments)
+	},
+}
+
+var rcRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "remove a fragment",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fragments := readRcIndex()
+		fragment := findRcFragment(fragments, args[0])
+		if fragment.Package != "" {
+			log.Fatalf("%v belongs to %v, disable it instead", fragment.Name, fragment.Package)
+		}
+		_ = os.Remove(fragment.Path)
+		fragments = removeRcFragments(fragments, func(f RcFragment) bool {
+			return f.Name == fragment.Name
+		})
+		writeRcIndex(fragments)
+	},
+}
+
+var rcListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list fragments in the order they are sourced",
+	Run: func(cmd *cobra.Command, args []string) {
+		fragments := readRcIndex()
+		for _, fragment := range fragments {
+			status := "enabled"
+			if fragment.Disabled {
+				status = "disabled"
+			}
+			source := "user"
+			if fragment.Package != "" {
+				source = fragment.Package
+				if fragment.Subpkg != "" {
+					source += " (" + fragment.Subpkg + ")"
+				}
+			}
+			fmt.Printf("%3d  %-30s %-9s %v\n", fragment.Order, fragment.Name, status, source)
+		}
+	},
+}
+
+var rcEnableCmd = &cobra.Command{
+	Use:   "enable <name>",
+	Short: "enable a fragment",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setRcFragmentDisabled(args[0], false)
+	},
+}
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+var rcDisableCmd = &cobra.Command{
+	Use:   "disable <name>",
+	Short: "disable a fragment without removing it",
+	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("rc called")
+		setRcFragmentDisabled(args[0], true)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(rcCmd)
+	rcCmd.AddCommand(rcAddCmd)
+	rcCmd.AddCommand(rcRemoveCmd)
+	rcCmd.AddCommand(rcListCmd)
+	rcCmd.AddCommand(rcEnableCmd)
+	rcCmd.AddCommand(rcDisableCmd)
 
-	// Here you will define your flags and configuration settings.
+	rcAddCmd.Flags().IntVarP(&rcOrder, "order", "o", defaultRcOrder,
+		"position in the loader (default is the numeric prefix of the name, or 50)")
+}
+
+func rcSourceLine() string {
+	loader := path.Join(rcDir, "zetup.rc")
+	return fmt.Sprintf("[ -f %v ] && . %v", shellQuote(loader), shellQuote(loader))
+}
+
+func setRcFragmentDisabled(name string, disabled bool) {
+	fragments := readRcIndex()
+	fragment := findRcFragment(fragments, name)
+	for i := range fragments {
+		if fragments[i].Name == fragment.Name {
+			fragments[i].Disabled = disabled
+		}
+	}
+	writeRcIndex(fragments)
+}
+
+func findRcFragment(fragments []RcFragment, name string) RcFragment {
+	for _, fragment := range fragments {
+		if fragment.Name == name {
+			return fragment
+		}
+	}
+	log.Fatalf("no rc fragment named %v", name)
+	return RcFragment{}
+}
+
+func removeRcFragments(fragments []RcFragment, remove func(RcFragment) bool) []RcFragment {
+	var kept []RcFragment
+	for _, fragment := range fragments {
+		if !remove(fragment) {
+			kept = append(kept, fragment)
+		}
+	}
+	return kept
+}
+
+var rcPrefixRegexp = regexp.MustCompile(`^(\d+)[-_]`)
+
+// "10-aliases.sh" is sourced at position 10
+func rcOrderFromName(name string) int {
+	match := rcPrefixRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return defaultRcOrder
+	}
+	order, err := strconv.Atoi(match[1])
+	if err != nil {
+		return defaultRcOrder
+	}
+	return order
+}
+
+// registerRcFragments registers every file in the rc/ directory of a package
+// or subpackage, replacing whatever that package registered before
+func registerRcFragments(dir string, pkg string, subpkg string) {
+	fragments := readRcIndex()
+	wasDisabled := map[string]bool{}
+	fragments = removeRcFragments(fragments, func(f RcFragment) bool {
+		if f.Package == pkg && f.Subpkg == subpkg {
+			// by path, fragments used to be named after the last part of pkg
+			wasDisabled[f.Path] = f.Disabled
+			return true
+		}
+		return false
+	})
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// rcCmd.PersistentFlags().String("foo", "", "A help for foo")
+	files, _ := ioutil.ReadDir(path.Join(dir, "rc"))
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		base := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+		// the whole pkg, so packages with the same repo name don't collide
+		name := pkg + "/"
+		if subpkg != "" {
+			name += subpkg + "/"
+		}
+		name += rcPrefixRegexp.ReplaceAllString(base, "")
+		fragmentFile := path.Join(dir, "rc", file.Name())
+		fragments = append(fragments, RcFragment{
+			Name:     name,
+			Order:    rcOrderFromName(file.Name()),
+			Package:  pkg,
+			Subpkg:   subpkg,
+			Path:     fragmentFile,
+			Disabled: wasDisabled[fragmentFile],
+		})
+	}
+	writeRcIndex(fragments)
+}
+
+// unregisterRcFragments removes everything a package and its subpackages registered
+func unregisterRcFragments(pkg string) {
+	fragments := readRcIndex()
+	fragments = removeRcFragments(fragments, func(f RcFragment) bool {
+		return f.Package == pkg
+	})
+	writeRcIndex(fragments)
+}
+
+func unregisterRcSubpkgFragments(pkg string, subpkg string) {
+	fragments := readRcIndex()
+	fragments = removeRcFragments(fragments, func(f RcFragment) bool {
+		return f.Package == pkg && f.Subpkg == subpkg
+	})
+	writeRcIndex(fragments)
+}
+
+func readRcIndex() []RcFragment {
+	var fragments []RcFragment
+	dat, err := ioutil.ReadFile(path.Join(rcDir, "index.yml"))
+	if os.IsNotExist(err) {
+		return fragments
+	}
+	check(err)
+	err = yaml.Unmarshal(dat, &fragments)
+	check(err)
+	return fragments
+}
+
+func writeRcIndex(fragments []RcFragment) {
+	sortRcFragments(fragments)
+	marshaled, err := yaml.Marshal(fragments)
+	check(err)
+	withHeader := []byte("# generated file do not edit, use `zetup rc`\n" + string(marshaled))
+	err = ioutil.WriteFile(path.Join(rcDir, "index.yml"), withHeader, 0644)
+	check(err)
+	writeRcLoader(fragments)
+}
+
+// numeric prefix, then package, then subpackage
+func sortRcFragments(fragments []RcFragment) {
+	sort.SliceStable(fragments, func(i, j int) bool {
+		a, b := fragments[i], fragments[j]
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.Subpkg != b.Subpkg {
+			return a.Subpkg < b.Subpkg
+		}
+		return a.Name < b.Name
+	})
+}
+
+func writeRcLoader(fragments []RcFragment) {
+	loader := "# generated file do not edit, use `zetup rc`\n"
+	loader += "# add this line to your .bashrc:\n"
+	loader += "# " + rcSourceLine() + "\n"
+	for _, fragment := range fragments {
+		if fragment.Disabled {
+			continue
+		}
+		quoted := shellQuote(fragment.Path)
+		loader += fmt.Sprintf("[ -f %v ] && . %v\n", quoted, quoted)
+	}
+	err := ioutil.WriteFile(path.Join(rcDir, "zetup.rc"), []byte(loader), 0644)
+	check(err)
+}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// rcCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
 }
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var recoverFinish bool
+
+// recoverCmd represents the recover command
+var recoverCmd = &cobra.Command{
+	Use:   "recover",
+	Short: "roll back or finish a zetup use that did not complete",
+	Long: `When zetup crashes or is killed in the middle of "zetup use", the steps it
+already completed are left in $ZETUP_DIR/journal.yml.
+
+By default recover undoes those steps in reverse order. With --finish it runs
+"zetup use" for the same package again instead, links and packages already
+in place are left alone, and if it fails it rolls back the interrupted run
+too.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		j, err := readJournal()
+		if os.IsNotExist(err) {
+			fmt.Println("nothing to recover")
+			return
+		}
+		check(err)
+		journal = j
+		usePkgDir = j.PkgDir
+
+		if recoverFinish {
+			pkgToInstall = j.Pkg
+			ensureRepo()
+			// the steps of the run are added to the interrupted ones, so a
+			// failure rolls back both
+			runJournaled(usePkg)
+			writeLock()
+			fmt.Printf("finished using %v\n", j.Pkg)
+			return
+		}
+
+		if !rollbackJournal() {
+			log.Fatal("could not roll back everything, fix the errors above and run `zetup recover` again")
+		}
+		fmt.Printf("rolled back %v\n", j.Pkg)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(recoverCmd)
+	recoverCmd.Flags().BoolVarP(&recoverFinish, "finish", "", false,
+		"finish the interrupted run instead of rolling it back")
+}
@@ -34,6 +34,19 @@ var rootCmd = &cobra.Command{
 	//Run: func(cmd *cobra.Command, args []string) {
 	//log.Println("print this")
 	//},
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if cmd.Annotations["dry-run"] == "true" {
+			dryRun = true
+		}
+		// doctor has to work when bootstrapping is what is broken
+		if cmd.Annotations["bootstrap"] == "false" {
+			return
+		}
+		if configErr != nil {
+			log.Fatalf("could not read %v: %v\nfix it or run `zetup doctor`", configFilePath(), configErr)
+		}
+		bootstrap()
+	},
 }
 
 func Execute() {
@@ -59,6 +72,12 @@ var publicKeyFile string
 var githubToken string
 var pkgDir string
 var verbose bool
+var dryRun bool
+var factsFile string
+var githubAPIURL string
+
+// configErr is why the config file could not be read, if it exists
+var configErr error
 
 var rcDir string
 
@@ -115,6 +134,10 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&name, "user.name", "", "", "your name")
 	rootCmd.PersistentFlags().StringVarP(&email, "user.email", "", "", "your email")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
+	rootCmd.PersistentFlags().StringVarP(&factsFile, "facts-file", "", "",
+		"yaml file overriding detected system facts, like id: fedora")
+	rootCmd.PersistentFlags().StringVarP(&githubAPIURL, "github-api-url", "", "",
+		"base url of the github api (default is https://api.github.com)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -165,6 +188,9 @@ func initConfig() {
 	// If a config file is found, read it in.
 	if err := mainViper.ReadInConfig(); err == nil {
 		//fmt.Println("Using config file:", mainViper.ConfigFileUsed())
+	} else if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound && !os.IsNotExist(err) {
+		// never overwrite a config file that is only malformed
+		configErr = err
 	} else {
 		// create config file, or it will just throw everything away
 		cfgPath := path.Join(mainViper.GetString("zetup-dir"), "config.yml")
@@ -207,9 +233,24 @@ func initConfig() {
 	bakDir = path.Join(zetupDir, ".bak")
 	_ = os.Mkdir(bakDir, 0755)
 
+}
+
+// configFilePath is the config file read, or the one that will be written
+func configFilePath() string {
+	if mainViper.ConfigFileUsed() != "" {
+		return mainViper.ConfigFileUsed()
+	}
+	return path.Join(zetupDir, "config.yml")
+}
+
+// bootstrap makes sure zetup can talk to github
+func bootstrap() {
 	ensureToken()
 	getUserInfo()
-	writeGitConfig()
+	// --dry-run shows the git config in the plan instead
+	if !dryRun {
+		writeGitConfig()
+	}
 	ensureSSHKey()
 	mainViper.WriteConfig()
 }
@@ -257,6 +298,19 @@ func ensureSSHKey() {
 	}
 }
 
+// githubAPI returns the url of apiPath on the github api, the base can be changed
+// with github-api-url for testing against another server
+func githubAPI(apiPath string) string {
+	base := githubAPIURL
+	if base == "" {
+		base = mainViper.GetString("github-api-url")
+	}
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	return strings.TrimRight(base, "/") + apiPath
+}
+
 type SSHKeyInfo struct {
 	Id int `json:"id"`
 }
@@ -266,7 +320,7 @@ func addPublicKeyToGithub(pubKey string, githubToken string) {
 				"title": "%v",
 				"key": "%v"
 			}`, mainViper.GetString("installation-id"), strings.TrimRight(pubKey, "\n")))
-	req, err := http.NewRequest("POST", "https://api.github.com/user/keys", body)
+	req, err := http.NewRequest("POST", githubAPI("/user/keys"), body)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -303,12 +357,15 @@ func check(err error) {
 }
 
 func writeGitConfig() {
-	gitConfigFile := fmt.Sprintf(`[user]
+	home, _ := homedir.Dir()
+	_ = ioutil.WriteFile(path.Join(home, ".gitconfig"), []byte(gitConfig()), 0644)
+}
+
+func gitConfig() string {
+	return fmt.Sprintf(`[user]
 	name = %v
 	email = %v
 `, mainViper.Get("user.name"), mainViper.Get("user.email"))
-	home, _ := homedir.Dir()
-	_ = ioutil.WriteFile(path.Join(home, ".gitconfig"), []byte(gitConfigFile), 0644)
 }
 
 type UserInfo struct {
@@ -332,7 +389,7 @@ func getUserInfo() {
 	log.Println("getting from api")
 
 	// get info with personal access token
-	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+	req, err := http.NewRequest("GET", githubAPI("/user"), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -420,7 +477,7 @@ func ensureToken() {
 	}
 	body := bytes.NewReader(payloadBytes)
 
-	req, err := http.NewRequest("POST", "https://api.github.com/authorizations", body)
+	req, err := http.NewRequest("POST", githubAPI("/authorizations"), body)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	ssh2 "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// PkgSource is where a package is cloned from, it is stored in
+// pkgDir/<host>/<owner>/<repo>
+type PkgSource struct {
+	Host  string
+	Owner string
+	Repo  string
+	URL   string
+	// tag, branch or commit from owner/repo@ref, empty for the default branch
+	Ref string
+}
+
+// HostConfig is an entry in the `hosts` list of config.yml
+//
+//	hosts:
+//	  - host: git.example.com
+//	    protocol: ssh
+//	    user: git
+//	    private-key-file: ~/.ssh/id_ed25519
+//	  - host: gitlab.example.com
+//	    user: me
+//	    token: xxxxxxxx
+type HostConfig struct {
+	Host string `mapstructure:"host"`
+	// ssh or https, used to build the url for host/owner/repo
+	Protocol       string `mapstructure:"protocol"`
+	User           string `mapstructure:"user"`
+	Token          string `mapstructure:"token"`
+	PrivateKeyFile string `mapstructure:"private-key-file"`
+}
+
+// git@host:owner/repo.git
+var scpLikeRegexp = regexp.MustCompile(`^(?:([^@/:]+)@)?([^@/:]+):(.+)$`)
+
+// parsePkgSource accepts
+//
+//	name                   github.com/<github-username>/name
+//	owner/repo             github.com/owner/repo
+//	host/owner/repo        any host, https unless configured otherwise
+//	https://host/owner/repo.git, ssh://git@host/owner/repo.git
+//	git@host:owner/repo.git
+//	file:///path/to/repo.git
+//
+// any of which can end in @tag, @branch or @commit
+func parsePkgSource(pkg string) (PkgSource, error) {
+	var source PkgSource
+	pkg, source.Ref = splitRef(pkg)
+	switch {
+	case strings.HasPrefix(pkg, "file://"):
+		repoPath := path.Clean(strings.TrimPrefix(pkg, "file://"))
+		_, repo := splitRepoPath(repoPath)
+		// local repos with the same name in different directories get
+		// their own clone
+		sum := sha256.Sum256([]byte(repoPath))
+		source.Host = "local"
+		source.Owner = hex.EncodeToString(sum[:])[:12]
+		source.Repo = repo
+		source.URL = pkg
+	case strings.Contains(pkg, "://"):
+		u, err := url.Parse(pkg)
+		if err != nil {
+			return source, err
+		}
+		source.Host = u.Hostname()
+		source.Owner, source.Repo = splitRepoPath(u.Path)
+		source.URL = pkg
+	case scpLikeRegexp.MatchString(pkg):
+		match := scpLikeRegexp.FindStringSubmatch(pkg)
+		source.Host = match[2]
+		source.Owner, source.Repo = splitRepoPath(match[3])
+		source.URL = pkg
+	default:
+		splitPath := strings.Split(strings.Trim(pkg, "/"), "/")
+		switch {
+		case len(splitPath) == 1:
+			splitPath = []string{"github.com", mainViper.GetString("github-username"), splitPath[0]}
+		case len(splitPath) == 2:
+			splitPath = append([]string{"github.com"}, splitPath...)
+		case !strings.Contains(splitPath[0], "."):
+			return source, fmt.Errorf("%v is not a host, use host/owner/repo or a git url", splitPath[0])
+		}
+		source.Host = splitPath[0]
+		source.Owner, source.Repo = splitRepoPath(path.Join(splitPath[1:]...))
+		source.URL = defaultSourceURL(source)
+	}
+
+	if source.Host == "" || source.Owner == "" || source.Repo == "" {
+		return source, fmt.Errorf("could not find host, owner and repo in %v", pkg)
+	}
+	// the parts are directories in pkgDir, so they can't leave it
+	for _, part := range append(append([]string{source.Host}, strings.Split(source.Owner, "/")...), source.Repo) {
+		if part == "" || part == "." || part == ".." {
+			return source, fmt.Errorf("%q can not be part of a package, in %v", part, pkg)
+		}
+	}
+	return source, nil
+}
+
+// splitRef splits owner/repo@v1.0 into owner/repo and v1.0, the @ in
+// git@host:owner/repo and ssh://git@host/owner/repo is not a ref
+func splitRef(pkg string) (string, string) {
+	offset := 0
+	if i := strings.Index(pkg, "://"); i >= 0 {
+		offset = i + len("://")
+	}
+	rest := pkg[offset:]
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return pkg, ""
+	}
+	// name@feature/x has a ref with a slash in it
+	if sep := strings.IndexAny(rest, "/:"); sep >= 0 && at < sep && (offset > 0 || rest[sep] == ':') {
+		return pkg, ""
+	}
+	return pkg[:offset+at], pkg[offset+at+1:]
+}
+
+// owner can contain slashes for nested groups on gitlab
+func splitRepoPath(repoPath string) (string, string) {
+	repoPath = strings.Trim(repoPath, "/")
+	owner, repo := path.Split(repoPath)
+	return strings.TrimSuffix(owner, "/"), strings.TrimSuffix(repo, ".git")
+}
+
+func defaultSourceURL(source PkgSource) string {
+	hostConfig := getHostConfig(source.Host)
+	protocol := hostConfig.Protocol
+	if protocol == "" && source.Host == "github.com" && source.Owner == mainViper.GetString("github-username") {
+		// zetup added its ssh key to your github account
+		protocol = "ssh"
+	}
+	if protocol == "ssh" {
+		user := hostConfig.User
+		if user == "" {
+			user = "git"
+		}
+		return user + "@" + source.Host + ":" + source.Owner + "/" + source.Repo + ".git"
+	}
+	return "https://" + source.Host + "/" + source.Owner + "/" + source.Repo + ".git"
+}
+
+func getHostConfig(host string) HostConfig {
+	var hostConfigs []HostConfig
+	err := mainViper.UnmarshalKey("hosts", &hostConfigs)
+	if err != nil {
+		log.Fatalf("could not read hosts from config: %v", err)
+	}
+	for _, hostConfig := range hostConfigs {
+		if hostConfig.Host == host {
+			return hostConfig
+		}
+	}
+	return HostConfig{Host: host}
+}
+
+// String is the source without the ref, as it can be passed to `zetup use`
+func (source PkgSource) String() string {
+	return source.URL
+}
+
+// Dir is where the package is cloned
+func (source PkgSource) Dir() string {
+	return path.Join(pkgDir, source.Host, source.Owner, source.Repo)
+}
+
+func (source PkgSource) Auth() (transport.AuthMethod, error) {
+	hostConfig := getHostConfig(source.Host)
+	switch {
+	case strings.HasPrefix(source.URL, "file://"):
+		return nil, nil
+	case strings.HasPrefix(source.URL, "http://") || strings.HasPrefix(source.URL, "https://"):
+		if hostConfig.Token == "" {
+			return nil, nil
+		}
+		user := hostConfig.User
+		if user == "" {
+			// most hosts ignore the user name when a token is used
+			user = "zetup"
+		}
+		return &http.BasicAuth{Username: user, Password: hostConfig.Token}, nil
+	}
+
+	// ssh:// or git@host:owner/repo
+	user := "git"
+	if u, err := url.Parse(source.URL); err == nil && u.User != nil {
+		user = u.User.Username()
+	} else if match := scpLikeRegexp.FindStringSubmatch(source.URL); match != nil && match[1] != "" {
+		user = match[1]
+	} else if hostConfig.User != "" {
+		user = hostConfig.User
+	}
+	privateKeyFile := mainViper.GetString("private-key-file")
+	if hostConfig.PrivateKeyFile != "" {
+		privateKeyFile, _ = homedir.Expand(hostConfig.PrivateKeyFile)
+	}
+	pem, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %v: %v", privateKeyFile, err)
+	}
+	return &ssh2.PublicKeys{User: user, Signer: signer}, nil
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSplitRef(t *testing.T) {
+	tests := []struct {
+		pkg, rest, ref string
+	}{
+		{"dotfiles", "dotfiles", ""},
+		{"dotfiles@v1.0", "dotfiles", "v1.0"},
+		{"dotfiles@feature/x", "dotfiles", "feature/x"},
+		{"me/dotfiles@feature/x", "me/dotfiles", "feature/x"},
+		{"github.com/me/dotfiles@abc123", "github.com/me/dotfiles", "abc123"},
+		{"git@github.com:me/dotfiles.git", "git@github.com:me/dotfiles.git", ""},
+		{"git@github.com:me/dotfiles.git@v1", "git@github.com:me/dotfiles.git", "v1"},
+		{"ssh://git@github.com/me/dotfiles.git", "ssh://git@github.com/me/dotfiles.git", ""},
+		{"ssh://git@github.com/me/dotfiles.git@feature/x", "ssh://git@github.com/me/dotfiles.git", "feature/x"},
+		{"https://github.com/me/dotfiles.git@v2", "https://github.com/me/dotfiles.git", "v2"},
+		{"file:///srv/git/dotfiles.git@main", "file:///srv/git/dotfiles.git", "main"},
+	}
+	for _, test := range tests {
+		rest, ref := splitRef(test.pkg)
+		if rest != test.rest || ref != test.ref {
+			t.Errorf("splitRef(%q) = %q, %q, want %q, %q", test.pkg, rest, ref, test.rest, test.ref)
+		}
+	}
+}
+
+func TestParsePkgSource(t *testing.T) {
+	mainViper.Set("github-username", "me")
+	defer mainViper.Set("github-username", nil)
+
+	tests := []struct {
+		pkg                    string
+		host, owner, repo, ref string
+		url                    string
+	}{
+		{"dotfiles", "github.com", "me", "dotfiles", "", "git@github.com:me/dotfiles.git"},
+		{"dotfiles@feature/x", "github.com", "me", "dotfiles", "feature/x", "git@github.com:me/dotfiles.git"},
+		{"you/dotfiles", "github.com", "you", "dotfiles", "", "https://github.com/you/dotfiles.git"},
+		{"gitlab.com/group/sub/dotfiles@v1", "gitlab.com", "group/sub", "dotfiles", "v1", "https://gitlab.com/group/sub/dotfiles.git"},
+		{"https://git.example.com/you/dotfiles.git", "git.example.com", "you", "dotfiles", "", "https://git.example.com/you/dotfiles.git"},
+		{"git@git.example.com:you/dotfiles.git@abc", "git.example.com", "you", "dotfiles", "abc", "git@git.example.com:you/dotfiles.git"},
+	}
+	for _, test := range tests {
+		source, err := parsePkgSource(test.pkg)
+		if err != nil {
+			t.Errorf("parsePkgSource(%q): %v", test.pkg, err)
+			continue
+		}
+		if source.Host != test.host || source.Owner != test.owner || source.Repo != test.repo ||
+			source.Ref != test.ref || source.URL != test.url {
+			t.Errorf("parsePkgSource(%q) = %+v", test.pkg, source)
+		}
+	}
+
+	invalid := []string{
+		"github.com/../../x",
+		"github.com/me/..",
+		"github.com/./x",
+		"../x",
+		"https://github.com/../x.git",
+		"git@github.com:me/...git",
+		"notahost/me/x",
+	}
+	for _, pkg := range invalid {
+		if source, err := parsePkgSource(pkg); err == nil {
+			t.Errorf("parsePkgSource(%q) = %+v, want an error", pkg, source)
+		}
+	}
+}
+
+func TestLocalPkgSourceDir(t *testing.T) {
+	a, err := parsePkgSource("file:///home/me/a/dotfiles.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parsePkgSource("file:///srv/a/dotfiles.git@v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Dir() == b.Dir() {
+		t.Errorf("different local repos share %v", a.Dir())
+	}
+	if a.Repo != "dotfiles" || path.Base(a.Dir()) != "dotfiles" {
+		t.Errorf("local repo is cloned to %v", a.Dir())
+	}
+	if !strings.HasPrefix(a.Dir(), path.Join(pkgDir, "local")+"/") {
+		t.Errorf("local repo is not cloned in pkgDir: %v", a.Dir())
+	}
+	c, _ := parsePkgSource("file:///home/me/a/../a/dotfiles.git")
+	if a.Dir() != c.Dir() {
+		t.Errorf("the same repo is cloned to %v and %v", a.Dir(), c.Dir())
+	}
+}
@@ -0,0 +1,350 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+var statusNoFetch bool
+
+// Status is the state of the package in use compared to what was applied
+type Status struct {
+	Pkg    string `json:"pkg"`
+	PkgDir string `json:"pkgDir"`
+	// Commit was applied by the last `zetup use`, Head is checked out now
+	Commit string `json:"commit"`
+	Head   string `json:"head"`
+	Dirty  bool   `json:"dirty"`
+	// Remote is up to date, behind, ahead, diverged, pinned or unknown
+	Remote          string          `json:"remote"`
+	Behind          int             `json:"behind"`
+	FetchError      string          `json:"fetchError,omitempty"`
+	Links           []LinkStatus    `json:"links"`
+	MissingPackages []StatusPackage `json:"missingPackages"`
+	Drifted         bool            `json:"drifted"`
+}
+
+type LinkStatus struct {
+	Scope  string `json:"scope"`
+	Src    string `json:"src"`
+	Target string `json:"target"`
+	Mode   string `json:"mode"`
+	// State is ok, missing, broken, replaced, elsewhere or changed
+	State string `json:"state"`
+}
+
+type StatusPackage struct {
+	Manager string `json:"manager"`
+	Name    string `json:"name"`
+}
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show whether the package in use is still applied",
+	Long: `Shows the package in use and the commit it was applied at, whether its
+clone has local changes or is behind its remote, the state of every link and
+the recorded packages that are gone.
+
+Link states are:
+  ok         in place
+  missing    nothing at the target
+  broken     links to the package, but the source is gone
+  replaced   a file or directory took the place of the link
+  elsewhere  a link to somewhere else
+  changed    a copy or template whose contents were edited
+
+Exits with 1 when the clone moved or has local changes, a link is not ok or
+a package is missing.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if mainViper.GetString("use-pkg") == "" {
+			fmt.Println("no package in use")
+			return
+		}
+		status := buildStatus()
+		if outputFormat == "json" {
+			out, err := json.MarshalIndent(status, "", "  ")
+			check(err)
+			fmt.Println(string(out))
+		} else {
+			printStatus(status)
+		}
+		if status.Drifted {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringVarP(&outputFormat, "output", "o", "text",
+		"output format, text or json")
+	statusCmd.Flags().BoolVarP(&statusNoFetch, "no-fetch", "", false,
+		"compare with the remote as of the last fetch")
+}
+
+func buildStatus() Status {
+	usePkgDir = mainViper.GetString("use-pkg")
+	source, err := parsePkgSource(mainViper.GetString("use-pkg-source"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	source.Ref = mainViper.GetString("use-pkg-ref")
+	usePkgSource = source
+
+	status := Status{
+		Pkg:             source.String() + refSuffix(source.Ref),
+		PkgDir:          usePkgDir,
+		Commit:          mainViper.GetString("use-pkg-commit"),
+		Head:            headCommit(usePkgDir),
+		MissingPackages: []StatusPackage{},
+	}
+	r, err := git.PlainOpen(usePkgDir)
+	if err != nil {
+		log.Fatalf("could not open %v: %v", usePkgDir, err)
+	}
+	if w, err := r.Worktree(); err == nil {
+		if gitStatus, err := w.Status(); err == nil {
+			status.Dirty = !gitStatus.IsClean()
+		}
+	}
+	status.Remote, status.Behind, status.FetchError = remoteStatus(r, source)
+
+	status.Links, err = linkStatuses()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, manager := range usedPackageManagers() {
+		for _, name := range recordedPackages(manager) {
+			if ok, _ := manager.Installed(name); !ok {
+				status.MissingPackages = append(status.MissingPackages, StatusPackage{manager.Name(), name})
+			}
+		}
+	}
+
+	status.Drifted = status.Dirty || status.Head != status.Commit || len(status.MissingPackages) > 0
+	for _, link := range status.Links {
+		if link.State != "ok" {
+			status.Drifted = true
+		}
+	}
+	return status
+}
+
+// linkStatuses checks every link of the package in use, the packages it
+// depends on and their subpackages
+func linkStatuses() ([]LinkStatus, error) {
+	links := []LinkStatus{}
+	depends, err := readUseDepends()
+	if err != nil {
+		return nil, err
+	}
+	for _, dep := range depends {
+		err := withPkg(dep, func() error {
+			depLinks, err := pkgLinkStatuses(pkgKey(usePkgDir) + " ")
+			links = append(links, depLinks...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	pkgLinks, err := pkgLinkStatuses("")
+	if err != nil {
+		return nil, err
+	}
+	return append(links, pkgLinks...), nil
+}
+
+// pkgLinkStatuses checks the links of usePkgDir and its subpackages, prefix
+// goes in front of their scope
+func pkgLinkStatuses(prefix string) ([]LinkStatus, error) {
+	links := []LinkStatus{}
+	scopes, err := listScopes()
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range scopes {
+		scopeName := prefix + "main"
+		if scope.Subpkg != "" {
+			scopeName = prefix + "subpkg " + scope.Subpkg
+		}
+		toLinkFiles, err := renderLinks(scope.Viper)
+		if err != nil {
+			return nil, err
+		}
+		tplInfo := newTplInfo(scope.Viper)
+		for _, toLinkFile := range toLinkFiles {
+			var rendered string
+			if toLinkFile.Mode == "template" {
+				rendered, _ = renderTemplateFile(toLinkFile.Src, tplInfo)
+			}
+			links = append(links, LinkStatus{
+				Scope:  scopeName,
+				Src:    toLinkFile.Src,
+				Target: toLinkFile.Target,
+				Mode:   toLinkFile.Mode,
+				State:  linkState(toLinkFile, rendered),
+			})
+		}
+	}
+	return links, nil
+}
+
+// linkState describes how the target differs from what placeLink would make
+func linkState(toLinkFile ToLink, rendered string) string {
+	if linkInPlace(toLinkFile, rendered) {
+		// symlinks are in place even if what they link to is gone
+		if _, err := os.Stat(toLinkFile.Target); err != nil {
+			return "broken"
+		}
+		return "ok"
+	}
+	info, err := os.Lstat(toLinkFile.Target)
+	if err != nil {
+		return "missing"
+	}
+	isLink := info.Mode()&os.ModeSymlink != 0
+	switch toLinkFile.Mode {
+	case "symlink", "relative":
+		if !isLink {
+			return "replaced"
+		}
+		return "elsewhere"
+	case "copy", "template":
+		if isLink {
+			return "elsewhere"
+		}
+		if info.Mode().IsRegular() {
+			return "changed"
+		}
+		return "replaced"
+	}
+	// hardlinks
+	if _, err := os.Stat(toLinkFile.Src); err != nil {
+		return "broken"
+	}
+	if isLink {
+		return "elsewhere"
+	}
+	return "replaced"
+}
+
+// remoteStatus compares HEAD with the branch it follows on origin
+func remoteStatus(r *git.Repository, source PkgSource) (string, int, string) {
+	var fetchError string
+	if !statusNoFetch {
+		auth, err := source.Auth()
+		if err == nil {
+			err = r.Fetch(&git.FetchOptions{RemoteName: "origin", Auth: auth})
+		}
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			fetchError = err.Error()
+		}
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return "unknown", 0, fetchError
+	}
+	var branch string
+	if source.Ref != "" {
+		if _, kind, err := resolveRef(r, source.Ref); err != nil || kind != "branch" {
+			return "pinned", 0, fetchError
+		}
+		branch = source.Ref
+	} else if head.Name().IsBranch() {
+		branch = head.Name().Short()
+	} else {
+		return "unknown", 0, fetchError
+	}
+	remote, err := r.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err != nil {
+		return "unknown", 0, fetchError
+	}
+	if remote.Hash() == head.Hash() {
+		return "up to date", 0, fetchError
+	}
+	if behind, ok := commitsUntil(r, remote.Hash(), head.Hash()); ok {
+		return "behind", behind, fetchError
+	}
+	if _, ok := commitsUntil(r, head.Hash(), remote.Hash()); ok {
+		return "ahead", 0, fetchError
+	}
+	return "diverged", 0, fetchError
+}
+
+// commitsUntil counts the commits from `from` back to `until`, ok is false
+// when until is not in the history of from
+func commitsUntil(r *git.Repository, from plumbing.Hash, until plumbing.Hash) (int, bool) {
+	commits, err := r.Log(&git.LogOptions{From: from})
+	if err != nil {
+		return 0, false
+	}
+	count := 0
+	found := false
+	_ = commits.ForEach(func(c *object.Commit) error {
+		if c.Hash == until {
+			found = true
+			return storer.ErrStop
+		}
+		count++
+		return nil
+	})
+	return count, found
+}
+
+func printStatus(status Status) {
+	fmt.Printf("using %v (%v)\n", status.Pkg, status.PkgDir)
+	if status.Head == status.Commit {
+		fmt.Printf("  commit %.7v\n", status.Commit)
+	} else {
+		fmt.Printf("  commit %.7v, but %.7v is checked out, run `zetup use` to apply it\n", status.Commit, status.Head)
+	}
+	if status.Dirty {
+		fmt.Println("  has local changes")
+	}
+	switch status.Remote {
+	case "behind":
+		fmt.Printf("  %v commits behind origin, run `zetup update`\n", status.Behind)
+	case "up to date":
+		fmt.Println("  up to date with origin")
+	case "ahead":
+		fmt.Println("  ahead of origin")
+	case "diverged":
+		fmt.Println("  diverged from origin")
+	case "pinned":
+		fmt.Println("  pinned to a tag or commit")
+	default:
+		fmt.Println("  could not compare with origin")
+	}
+	if status.FetchError != "" {
+		fmt.Printf("  could not fetch: %v\n", status.FetchError)
+	}
+
+	if len(status.Links) > 0 {
+		fmt.Println("\nlinks:")
+	}
+	for _, link := range status.Links {
+		fmt.Printf("  %-9v %v -> %v (%v, %v)\n", link.State, link.Target, link.Src, link.Mode, link.Scope)
+	}
+	if len(status.MissingPackages) > 0 {
+		fmt.Println("\nrecorded packages that are gone:")
+	}
+	for _, pkg := range status.MissingPackages {
+		fmt.Printf("  %v %v\n", pkg.Manager, pkg.Name)
+	}
+	if status.Drifted {
+		fmt.Println("\nsomething changed since the package was applied")
+	}
+}
@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// subpkgCmd represents the subpkg command
+var subpkgCmd = &cobra.Command{
+	Use:   "subpkg",
+	Short: "show the subpackages of the package in use",
+	Long: `Every directory in subpkg/ of a package is a subpackage. Subpackages are
+only used on linux. A subpackage is used unless "zetup use --only" or
+"--skip" leave it out, or the "when" conditions in its config.yml don't match
+this machine:
+
+	when:
+	  # any of these
+	  distro: [ubuntu, fedora]  # the distro id, or one it is based on
+	  arch: amd64               # or x86_64, as uname -m prints it
+	  hostname: work-*          # a glob
+	  # all of these
+	  env: [DISPLAY, XDG_SESSION_TYPE=wayland]
+	  command: [tmux, nvim]`,
+}
+
+var subpkgListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list subpackages, whether they are used and why",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if mainViper.GetString("use-pkg") == "" {
+			fmt.Println("no package in use")
+			return
+		}
+		pkgs, err := readUseDepends()
+		check(err)
+		root, err := parsePkgSource(mainViper.GetString("use-pkg-source"))
+		check(err)
+		pkgs = append(pkgs, root)
+		if only := mainViper.GetStringSlice("use-pkg-only"); len(only) > 0 {
+			fmt.Printf("only %v\n", strings.Join(only, ", "))
+		}
+		if skip := mainViper.GetStringSlice("use-pkg-skip"); len(skip) > 0 {
+			fmt.Printf("skipping %v\n", strings.Join(skip, ", "))
+		}
+		for _, pkg := range pkgs {
+			_ = withPkg(pkg, func() error {
+				subpkgDirs, err := getListOfSubpkgs()
+				check(err)
+				fmt.Println(pkgKey(usePkgDir))
+				if len(subpkgDirs) == 0 {
+					fmt.Println("  no subpackages")
+				}
+				for _, subpkgDir := range subpkgDirs {
+					active, reason := subpkgActive(subpkgDir, readPkgViper(subpkgDir))
+					state := "inactive"
+					if active {
+						state = "active"
+					}
+					fmt.Printf("  %-16v %-8v %v\n", path.Base(subpkgDir), state, reason)
+				}
+				return nil
+			})
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(subpkgCmd)
+	subpkgCmd.AddCommand(subpkgListCmd)
+}
+
+// getActiveSubpkgs lists the subpackages of usePkgDir that are used
+func getActiveSubpkgs() ([]string, error) {
+	subpkgDirs, err := getListOfSubpkgs()
+	if err != nil {
+		return nil, err
+	}
+	var active []string
+	for _, subpkgDir := range subpkgDirs {
+		if ok, _ := subpkgActive(subpkgDir, readPkgViper(subpkgDir)); ok {
+			active = append(active, subpkgDir)
+		}
+	}
+	return active, nil
+}
+
+// subpkgActive decides whether the subpackage in subpkgDir is used, vip is
+// its config, reason says why
+func subpkgActive(subpkgDir string, vip *viper.Viper) (bool, string) {
+	name := path.Base(subpkgDir)
+	if containsString(mainViper.GetStringSlice("use-pkg-skip"), name) {
+		return false, "skipped with --skip"
+	}
+	if only := mainViper.GetStringSlice("use-pkg-only"); len(only) > 0 && !containsString(only, name) {
+		return false, "not in --only"
+	}
+	if runtime.GOOS != "linux" {
+		return false, "subpackages are only used on linux"
+	}
+	if !vip.IsSet("when") {
+		return true, "always"
+	}
+	if ok, reason := whenMatches(vip); !ok {
+		return false, reason
+	}
+	return true, "when matches"
+}
+
+// whenMatches checks the `when` conditions of vip against the facts of this
+// machine, reason is the first condition that doesn't match
+func whenMatches(vip *viper.Viper) (bool, string) {
+	machine := getFacts()
+	for _, condition := range sortedConditions(vip.GetStringMap("when")) {
+		values := vip.GetStringSlice("when." + condition)
+		switch condition {
+		case "os":
+			if !containsString(values, machine.OS) {
+				return false, fmt.Sprintf("needs os %v, not %v", strings.Join(values, " or "), machine.OS)
+			}
+		case "distro":
+			matched := false
+			for _, distro := range values {
+				if machine.IsLike(distro) {
+					matched = true
+				}
+			}
+			if !matched {
+				return false, fmt.Sprintf("needs distro %v, not %v", strings.Join(values, " or "), machine.ID)
+			}
+		case "arch":
+			matched := false
+			for _, arch := range values {
+				if machine.IsArch(arch) {
+					matched = true
+				}
+			}
+			if !matched {
+				return false, fmt.Sprintf("needs arch %v, not %v", strings.Join(values, " or "), machine.Arch)
+			}
+		case "hostname":
+			matched := false
+			for _, pattern := range values {
+				if ok, _ := path.Match(pattern, machine.Hostname); ok {
+					matched = true
+				}
+			}
+			if !matched {
+				return false, fmt.Sprintf("needs hostname %v, not %v", strings.Join(values, " or "), machine.Hostname)
+			}
+		case "env":
+			for _, env := range values {
+				// NAME is set, or NAME=glob
+				parts := strings.SplitN(env, "=", 2)
+				value, set := os.LookupEnv(parts[0])
+				if !set || (len(parts) == 1 && value == "") {
+					return false, fmt.Sprintf("needs $%v", parts[0])
+				}
+				if len(parts) == 2 {
+					if ok, _ := path.Match(parts[1], value); !ok {
+						return false, fmt.Sprintf("needs $%v to be %v, not %v", parts[0], parts[1], value)
+					}
+				}
+			}
+		case "command":
+			for _, command := range values {
+				if !hasCommand(command) {
+					return false, fmt.Sprintf("needs command %v", command)
+				}
+			}
+		default:
+			return false, fmt.Sprintf("unknown condition %v", condition)
+		}
+	}
+	return true, ""
+}
+
+// conditions are checked in a fixed order so the reason is always the same
+func sortedConditions(when map[string]interface{}) []string {
+	known := []string{"os", "distro", "arch", "hostname", "env", "command"}
+	var conditions []string
+	for _, condition := range known {
+		if _, ok := when[condition]; ok {
+			conditions = append(conditions, condition)
+		}
+	}
+	for condition := range when {
+		if !containsString(known, condition) {
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions
+}
+
+// subpkgsChanged is whether a subpackage of usePkgDir became active or
+// inactive since it was applied
+func subpkgsChanged() bool {
+	subpkgDirs, err := getListOfSubpkgs()
+	if err != nil {
+		return false
+	}
+	for _, subpkgDir := range subpkgDirs {
+		active, _ := subpkgActive(subpkgDir, readPkgViper(subpkgDir))
+		if active != subpkgApplied(path.Base(subpkgDir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// subpkgApplied is whether zetup used the subpackage of usePkgDir and has not
+// undone it since, applied-subpkgs are the backup scopes of those
+func subpkgApplied(subpkg string) bool {
+	return containsString(mainViper.GetStringSlice("applied-subpkgs"), backupScope(subpkg))
+}
+
+// setSubpkgApplied records that the subpackage of usePkgDir was used or undone
+func setSubpkgApplied(subpkg string, applied bool) {
+	appliedScopes := mainViper.GetStringSlice("applied-subpkgs")
+	if applied == containsString(appliedScopes, backupScope(subpkg)) {
+		return
+	}
+	journalRecord(JournalEntry{Action: "applied-subpkgs", Args: appliedScopes})
+	scopes := []string{}
+	for _, scope := range appliedScopes {
+		if scope != backupScope(subpkg) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if applied {
+		scopes = append(scopes, backupScope(subpkg))
+	}
+	mainViper.Set("applied-subpkgs", scopes)
+	mainViper.WriteConfig()
+}
+
+// deactivateSubpkg undoes a subpackage that was used before but is not active
+// anymore, and records that it is not applied
+func deactivateSubpkg(subpkgDir string, vip *viper.Viper) {
+	subpkg := path.Base(subpkgDir)
+	if subpkgApplied(subpkg) {
+		_, reason := subpkgActive(subpkgDir, vip)
+		log.Printf("undoing subpackage %v of %v, %v\n", subpkg, pkgKey(usePkgDir), reason)
+		journalDeactivateSubpkg(subpkg, vip)
+		unuseSubpkgScope(subpkgDir, vip, subpkg)
+		setSubpkgApplied(subpkg, false)
+	}
+}
+
+// journalDeactivateSubpkg records the links, rc fragments and package records
+// of a subpackage before it is undone, so a failed run puts them back
+func journalDeactivateSubpkg(subpkg string, vip *viper.Viper) {
+	scope := backupScope(subpkg)
+	toLinkFiles, err := renderLinks(vip)
+	if err != nil {
+		// removeLinks can't undo them either, the backups are still saved
+		log.Println(err)
+	}
+	snapshot, err := snapshotLinks(scope, toLinkFiles)
+	check(err)
+	var targets []string
+	for _, toLinkFile := range toLinkFiles {
+		targets = append(targets, toLinkFile.Target)
+	}
+	journalRecord(JournalEntry{Action: "link", Scope: scope, Args: targets, Snapshot: &snapshot})
+	journalRecordRc()
+	journalRecordPackages()
+}
+
+// selectSubpkgs remembers --only and --skip of `zetup use`, so update keeps
+// using the same subpackages, the returned entry undoes it once the journal
+// has begun
+func selectSubpkgs(only []string, skip []string) JournalEntry {
+	undo := JournalEntry{Action: "subpkg-selection", Args: []string{
+		strings.Join(mainViper.GetStringSlice("use-pkg-only"), ","),
+		strings.Join(mainViper.GetStringSlice("use-pkg-skip"), ","),
+	}}
+	mainViper.Set("use-pkg-only", append([]string{}, only...))
+	mainViper.Set("use-pkg-skip", append([]string{}, skip...))
+	return undo
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	"github.com/zetup-sh/zetup/cmd/facts"
+)
+
+// TplInfo is the data link paths are rendered with, like {{.Home}}
+type TplInfo struct {
+	Home string
+	// ZetupDir is the package directory, same as PkgDir
+	ZetupDir string
+	PkgDir   string
+	Facts    facts.Facts
+	User     TplUser
+	Env      map[string]string
+	// Vars are the `vars` of the package, overridden by the subpackage's own
+	Vars map[string]interface{}
+}
+
+type TplUser struct {
+	Name           string
+	Email          string
+	GithubUsername string
+}
+
+var tplFuncs = template.FuncMap{
+	"env": os.Getenv,
+	// {{default "vim" .Vars.editor}}
+	"default": func(def interface{}, value interface{}) interface{} {
+		if value == nil || value == "" {
+			return def
+		}
+		return value
+	},
+	"joinPath": func(elems ...string) string {
+		return filepath.Join(elems...)
+	},
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"hasCommand": hasCommand,
+}
+
+// newTplInfo builds the template data for curViper, a package or subpackage config
+func newTplInfo(curViper *viper.Viper) TplInfo {
+	home, _ := homedir.Dir()
+	env := map[string]string{}
+	for _, keyValue := range os.Environ() {
+		parts := strings.SplitN(keyValue, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	vars := readPkgViper(usePkgDir).GetStringMap("vars")
+	for key, value := range curViper.GetStringMap("vars") {
+		vars[key] = value
+	}
+	return TplInfo{
+		Home:     home,
+		ZetupDir: usePkgDir,
+		PkgDir:   usePkgDir,
+		Facts:    getFacts(),
+		User: TplUser{
+			Name:           mainViper.GetString("user.name"),
+			Email:          mainViper.GetString("user.email"),
+			GithubUsername: mainViper.GetString("github-username"),
+		},
+		Env:  env,
+		Vars: vars,
+	}
+}
+
+// renderTemplate executes text as a template with tplFuncs, name is used in errors
+func renderTemplate(name string, text string, tplInfo TplInfo) (string, error) {
+	tmpl, err := template.New(name).Funcs(tplFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("There was a problem with %v: %v", name, err)
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, tplInfo); err != nil {
+		return "", fmt.Errorf("There was a problem with %v: %v", name, err)
+	}
+	return rendered.String(), nil
+}
+
+// renderTemplateFile renders the contents of src, for links with mode template
+func renderTemplateFile(src string, tplInfo TplInfo) (string, error) {
+	dat, err := ioutil.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	return renderTemplate(src, string(dat), tplInfo)
+}
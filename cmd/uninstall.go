@@ -33,7 +33,7 @@ func deleteSSHKey() {
 	if sshKeyId == "" {
 		return
 	}
-	req, err := http.NewRequest("DELETE", "https://api.github.com/user/keys/"+sshKeyId, nil)
+	req, err := http.NewRequest("DELETE", githubAPI("/user/keys/"+sshKeyId), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -68,7 +68,7 @@ func deleteGithubToken() {
 			log.Fatal(err)
 		}
 	}
-	req, err := http.NewRequest("DELETE", "https://api.github.com/authorizations/"+githubTokenId, nil)
+	req, err := http.NewRequest("DELETE", githubAPI("/authorizations/"+githubTokenId), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
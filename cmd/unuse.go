@@ -1,55 +1,166 @@
 package cmd
 
 import (
-	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"runtime"
 
 	"github.com/spf13/cobra"
-	"gopkg.in/yaml.v2"
+	"github.com/spf13/viper"
 )
 
+var unuseSubpkg string
+var unusePurgePackages bool
+
 // unuseCmd represents the unuse command
 var unuseCmd = &cobra.Command{
 	Use:   "unuse",
 	Short: "undo all undoable changes made by a program",
-	Long:  `This will run the unuse command in the zetup package as well as restore backups to any linked files like bashrc or tmux.conf`,
+	Long: `This will run the unuse command in the zetup package as well as restore backups to any linked files like bashrc or tmux.conf
+
+The packages it depends on are undone after it, in reverse order.
+
+With --subpkg only that subpackage of the package in use is undone, it is
+applied again by the next "zetup use" or "zetup update".
+
+With --purge-packages the system packages zetup installed for the package
+are removed too, unless they were installed before zetup asked for them or
+another package or subpackage still needs them.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if unuseSubpkg != "" {
+			UnuseSubpkg(unuseSubpkg)
+			return
+		}
 		Unuse()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(unuseCmd)
+	unuseCmd.Flags().StringVarP(&unuseSubpkg, "subpkg", "", "",
+		"only undo this subpackage")
+	unuseCmd.Flags().BoolVarP(&unusePurgePackages, "purge-packages", "", false,
+		"remove the system packages zetup installed for the package")
 }
 
 func Unuse() {
-	RestoreBackupFiles()
-	unuseFile, err := FindFile(usePkgDir, "unuse", runtime.GOOS, LINUX_EXTENSIONS, mainViper)
-	if err == nil {
-		runFile(unuseFile)
+	if usePkgDir == "" {
+		usePkgDir = mainViper.GetString("use-pkg")
+	}
+	// without a package every scope would be empty, rc fragments of the
+	// user and scripts in the working directory would be undone
+	if usePkgDir == "" {
+		log.Fatal("no package in use")
+	}
+	unusePkg()
+
+	// dependencies were applied before the package, so undo them after it
+	depends, err := readUseDepends()
+	check(err)
+	for i := len(depends) - 1; i >= 0; i-- {
+		_ = withPkg(depends[i], func() error {
+			unusePkg()
+			return nil
+		})
 	}
+
+	// nothing is in use anymore, the next use of the package is a first one
+	setUsePkg("", "", "", "")
+	mainViper.Set("use-pkg-depends", []string{})
+	err = mainViper.WriteConfig()
+	check(err)
 }
 
-func RestoreBackupFiles() {
-	files, err := ioutil.ReadDir(bakDir)
+// unusePkg undoes usePkgDir and its subpackages
+func unusePkg() {
+	subpkgDirs, err := getListOfSubpkgs()
 	check(err)
-	var bakupFiles []string
-	for _, file := range files {
-		bakupFiles = append(bakupFiles, path.Join(bakDir, file.Name()))
+	err = runHook(usePkgDir, "", "pre-unuse", mainViper)
+	check(err)
+	// subpackages are used after the main package, so undo them first
+	for i := len(subpkgDirs) - 1; i >= 0; i-- {
+		subpkg := path.Base(subpkgDirs[i])
+		if !subpkgApplied(subpkg) {
+			continue
+		}
+		unuseSubpkgScope(subpkgDirs[i], readPkgViper(subpkgDirs[i]), subpkg)
+		setSubpkgApplied(subpkg, false)
+	}
+	unuseScope(usePkgDir, mainViper, "")
+	err = runHook(usePkgDir, "", "post-unuse", mainViper)
+	check(err)
+}
+
+func UnuseSubpkg(subpkg string) {
+	if usePkgDir == "" {
+		usePkgDir = mainViper.GetString("use-pkg")
 	}
+	if usePkgDir == "" {
+		log.Fatal("no package in use")
+	}
+	subpkgDir := path.Join(usePkgDir, "subpkg", subpkg)
+	if info, err := os.Stat(subpkgDir); err != nil || !info.IsDir() {
+		log.Fatalf("%v has no subpackage %v", pkgKey(usePkgDir), subpkg)
+	}
+	if !subpkgApplied(subpkg) {
+		log.Fatalf("subpackage %v of %v is not applied", subpkg, pkgKey(usePkgDir))
+	}
+	unuseSubpkgScope(subpkgDir, readPkgViper(subpkgDir), subpkg)
+	setSubpkgApplied(subpkg, false)
+}
 
-	for _, bakupFile := range bakupFiles {
-		// restore backups of linked files
-		dat, err := ioutil.ReadFile(bakupFile)
+// unuseSubpkgScope is unuseScope with the pre-unuse and post-unuse hooks of
+// the subpackage, unusePkg runs the hooks of the package around its
+// subpackages
+func unuseSubpkgScope(dir string, vip *viper.Viper, subpkg string) {
+	err := runHook(dir, subpkg, "pre-unuse", vip)
+	check(err)
+	unuseScope(dir, vip, subpkg)
+	err = runHook(dir, subpkg, "post-unuse", vip)
+	check(err)
+}
+
+// unuseScope removes the links of the package or subpackage in dir, restores
+// its backups, runs its unuse script and releases its system packages,
+// scriptViper is where FindFile looks up custom script names
+func unuseScope(dir string, scriptViper *viper.Viper, subpkg string) {
+	removeLinks(readPkgViper(dir))
+	err := restoreBackupScope(backupScope(subpkg))
+	check(err)
+	if subpkg == "" {
+		unregisterRcFragments(pkgKey(usePkgDir))
+	} else {
+		unregisterRcSubpkgFragments(pkgKey(usePkgDir), subpkg)
+	}
+	unuseFile, err := FindFile(dir, "unuse", runtime.GOOS, LINUX_EXTENSIONS, scriptViper)
+	if err == nil {
+		err = runFile(unuseFile, dir, subpkg)
 		check(err)
-		var backedupFiles []BackupFileInfo
-		yaml.Unmarshal(dat, &backedupFiles)
-		for _, backedupFile := range backedupFiles {
-			err = os.Remove(backedupFile.Location)
+	}
+	if runtime.GOOS == "linux" {
+		err = releasePackages(readPkgViper(dir), backupScope(subpkg), unusePurgePackages)
+		check(err)
+	}
+}
+
+// removeLinks removes the links, copies and rendered templates of curViper
+// that are still in place, anything changed since is left for the backups
+func removeLinks(curViper *viper.Viper) {
+	toLinkFiles, err := renderLinks(curViper)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	tplInfo := newTplInfo(curViper)
+	for _, toLinkFile := range toLinkFiles {
+		var rendered string
+		if toLinkFile.Mode == "template" {
+			rendered, _ = renderTemplateFile(toLinkFile.Src, tplInfo)
+		}
+		if linkInPlace(toLinkFile, rendered) {
+			err := os.Remove(toLinkFile.Target)
 			check(err)
-			ioutil.WriteFile(backedupFile.Location, []byte(backedupFile.Contents), 0644)
 		}
 	}
 }
@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// what a package scope looked like before an update
+type scopeSnapshot struct {
+	useFile string
+	useHash string
+	links   []ToLink
+}
+
+// updateCmd represents the update command
+var updateCmd = &cobra.Command{
+	Use:   "update [pkg]",
+	Short: "pull the latest version of a package and re-apply it",
+	Long: `Fetches and fast-forwards a package clone, including submodules, and
+shows the commits that came in. If the package is the one in use, only what
+changed is re-applied: new system and snap packages, changed links and use
+scripts that changed.
+
+The packages it depends on are not pulled, dependencies it needs now that
+were not applied yet are cloned and applied before it.
+
+Without arguments the package in use is updated. Packages pinned to a tag or
+commit stay where they are, use "zetup update pkg@ref" to move them.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var source PkgSource
+		var err error
+		if len(args) == 1 {
+			source, err = parsePkgSource(args[0])
+		} else {
+			if mainViper.GetString("use-pkg-source") == "" {
+				log.Fatal("no package in use, run `zetup update <pkg>` or `zetup use <pkg>`")
+			}
+			source, err = parsePkgSource(mainViper.GetString("use-pkg-source"))
+			source.Ref = mainViper.GetString("use-pkg-ref")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		usePkgSource = source
+		usePkgDir = source.Dir()
+		if _, err := os.Stat(usePkgDir); os.IsNotExist(err) {
+			log.Fatalf("%v has not been cloned, run `zetup use %v` first", pkgKey(usePkgDir), source.String()+refSuffix(source.Ref))
+		}
+		inUse := mainViper.GetString("use-pkg") == usePkgDir
+		var appliedDepends []PkgSource
+		if inUse {
+			ensureNoJournal()
+			appliedDepends, err = readUseDepends()
+			if err != nil {
+				log.Fatal(err)
+			}
+			useDepends = appliedDepends
+		}
+
+		before := snapshotScopes()
+		oldHead := headCommit(usePkgDir)
+		err = pullPkg(source)
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			log.Fatal(err)
+		}
+		newHead := headCommit(usePkgDir)
+		if newHead == oldHead {
+			// the when conditions of subpackages can match differently now
+			if !inUse || !subpkgsChanged() {
+				fmt.Printf("%v is already up to date\n", pkgKey(usePkgDir))
+				return
+			}
+			fmt.Printf("%v is already up to date, but its subpackages changed\n", pkgKey(usePkgDir))
+		} else {
+			printNewCommits(oldHead, newHead)
+		}
+
+		if !inUse {
+			fmt.Printf("%v is not in use, run `zetup use %v` to apply it\n", pkgKey(usePkgDir), source.String())
+			return
+		}
+		// dependencies are not pulled, but the ones the package needs now
+		// are cloned and applied before it
+		useDepends, err = resolveDepends(source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		added := newDepends(appliedDepends, useDepends)
+		beginJournal(source.String()+refSuffix(source.Ref), usePkgDir)
+		runJournaled(func() error {
+			for _, dep := range added {
+				if mainViper.GetBool("verbose") {
+					log.Printf("using new dependency %v\n", pkgKey(dep.Dir()))
+				}
+				if err := withPkg(dep, applyPkg); err != nil {
+					return err
+				}
+			}
+			if err := reapplyPkg(before); err != nil {
+				return err
+			}
+			recordUseDepends()
+			return nil
+		})
+		writeLock()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(updateCmd)
+}
+
+func refSuffix(ref string) string {
+	if ref == "" {
+		return ""
+	}
+	return "@" + ref
+}
+
+// newDepends are the dependencies in depends that were not applied yet, or
+// at another ref
+func newDepends(applied []PkgSource, depends []PkgSource) []PkgSource {
+	var added []PkgSource
+	for _, dep := range depends {
+		found := false
+		for _, appliedDep := range applied {
+			if appliedDep.Dir() == dep.Dir() && appliedDep.Ref == dep.Ref {
+				found = true
+			}
+		}
+		if !found {
+			added = append(added, dep)
+		}
+	}
+	return added
+}
+
+// pullPkg fast-forwards the default branch, or checks out source.Ref again
+// so branches move and tags and commits stay put
+func pullPkg(source PkgSource) error {
+	r, err := git.PlainOpen(usePkgDir)
+	if err != nil {
+		return err
+	}
+	if source.Ref != "" {
+		_, kind, err := checkoutRef(r, source)
+		if err == nil && kind != "branch" && mainViper.GetBool("verbose") {
+			log.Printf("%v is pinned to %v %v\n", pkgKey(usePkgDir), kind, source.Ref)
+		}
+		return err
+	}
+
+	auth, err := source.Auth()
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	err = w.Pull(&git.PullOptions{
+		RemoteName:        "origin",
+		Auth:              auth,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+	})
+	if err == git.ErrNonFastForwardUpdate {
+		return fmt.Errorf("%v has diverged from origin, fix it by hand in %v", pkgKey(usePkgDir), usePkgDir)
+	}
+	return err
+}
+
+func printNewCommits(oldHead string, newHead string) {
+	r, err := git.PlainOpen(usePkgDir)
+	check(err)
+	commits, err := r.Log(&git.LogOptions{From: plumbing.NewHash(newHead)})
+	check(err)
+	fmt.Printf("updated %v %.7v..%.7v\n", pkgKey(usePkgDir), oldHead, newHead)
+	_ = commits.ForEach(func(c *object.Commit) error {
+		if c.Hash.String() == oldHead {
+			return storer.ErrStop
+		}
+		summary := strings.SplitN(c.Message, "\n", 2)[0]
+		fmt.Printf("  %.7v %v\n", c.Hash.String(), summary)
+		return nil
+	})
+}
+
+// snapshotScopes records the use scripts and links of the package and its
+// applied subpackages, keyed by directory
+func snapshotScopes() map[string]scopeSnapshot {
+	snapshots := map[string]scopeSnapshot{}
+	snapshots[usePkgDir] = snapshotScope(usePkgDir, readPkgViper(usePkgDir), mainViper)
+	subpkgDirs, err := getListOfSubpkgs()
+	check(err)
+	for _, subpkgDir := range subpkgDirs {
+		// a subpackage that becomes active is used like it is new
+		if !subpkgApplied(path.Base(subpkgDir)) {
+			continue
+		}
+		subpkgViper := readPkgViper(subpkgDir)
+		snapshots[subpkgDir] = snapshotScope(subpkgDir, subpkgViper, subpkgViper)
+	}
+	return snapshots
+}
+
+func snapshotScope(dir string, vip *viper.Viper, scriptViper *viper.Viper) scopeSnapshot {
+	var snapshot scopeSnapshot
+	useFile, err := FindFile(dir, "use", runtime.GOOS, LINUX_EXTENSIONS, scriptViper)
+	if err == nil {
+		snapshot.useFile = useFile
+		snapshot.useHash = hashFile(useFile)
+	}
+	// a broken template is reported when the new version is applied
+	snapshot.links, _ = renderLinks(vip)
+	return snapshot
+}
+
+func hasContentLinks(links []ToLink) bool {
+	for _, link := range links {
+		if link.Mode == "template" || link.Mode == "copy" || link.Mode == "hardlink" {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFile(file string) string {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(dat))
+}
+
+// reapplyPkg is usePkg, but skips use scripts and links that did not change
+func reapplyPkg(before map[string]scopeSnapshot) error {
+	pkgViper = readPkgViper(usePkgDir)
+	if runtime.GOOS == "linux" {
+		if err := ensurePackages(pkgViper, backupScope("")); err != nil {
+			return err
+		}
+	}
+	pkgChanged, err := reapplyScope(usePkgDir, pkgViper, mainViper, "", before)
+	if err != nil {
+		return err
+	}
+
+	subpkgDirs, err := getListOfSubpkgs()
+	if err != nil {
+		return err
+	}
+	for _, subpkgDir := range subpkgDirs {
+		if err := checkInterrupted(); err != nil {
+			return err
+		}
+		subpkgViper := readPkgViper(subpkgDir)
+		base := path.Base(subpkgDir)
+		if active, _ := subpkgActive(subpkgDir, subpkgViper); !active {
+			deactivateSubpkg(subpkgDir, subpkgViper)
+			continue
+		}
+		if err := ensurePackages(subpkgViper, backupScope(base)); err != nil {
+			return err
+		}
+		changed, err := reapplyScope(subpkgDir, subpkgViper, subpkgViper, base, before)
+		if err != nil {
+			return err
+		}
+		setSubpkgApplied(base, true)
+		if changed {
+			if err := runHook(subpkgDir, base, "post-use", subpkgViper); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := checkInterrupted(); err != nil {
+		return err
+	}
+	if pkgChanged {
+		if err := runHook(usePkgDir, "", "post-use", mainViper); err != nil {
+			return err
+		}
+	}
+	recordUsePkg()
+	return nil
+}
+
+// reapplyScope re-applies what changed in the package or subpackage in dir,
+// changed is whether its use script or links did, only then its hooks run
+func reapplyScope(dir string, vip *viper.Viper, scriptViper *viper.Viper, subpkg string, before map[string]scopeSnapshot) (changed bool, err error) {
+	if err := checkInterrupted(); err != nil {
+		return false, err
+	}
+	old, existed := before[dir]
+	now := snapshotScope(dir, vip, scriptViper)
+	useChanged := now.useFile != "" && (!existed || now.useHash != old.useHash)
+	linksChanged := !existed || !reflect.DeepEqual(now.links, old.links)
+
+	if useChanged || linksChanged {
+		if err := runHook(dir, subpkg, "pre-use", scriptViper); err != nil {
+			return false, err
+		}
+	}
+	if useChanged {
+		if mainViper.GetBool("verbose") {
+			log.Printf("%v changed, running it\n", now.useFile)
+		}
+		if err := runFile(now.useFile, dir, subpkg); err != nil {
+			return false, err
+		}
+		// only a subpackage that was not applied before can be undone with
+		// its unuse script
+		if !existed {
+			journalRecord(JournalEntry{Action: "run-use", Dir: dir, Args: []string{subpkg}})
+		}
+	}
+
+	// LinkFiles skips links that are already in place, so templates, copies
+	// and hardlinks are always checked since their source may have changed
+	if linksChanged || hasContentLinks(now.links) {
+		if mainViper.GetBool("verbose") {
+			log.Printf("links in %v changed, relinking\n", dir)
+		}
+		if err := LinkFiles(vip, backupScope(subpkg)); err != nil {
+			return false, err
+		}
+	}
+	if linksChanged {
+		if err := runHook(dir, subpkg, "post-link", scriptViper); err != nil {
+			return false, err
+		}
+	}
+
+	journalRecordRc()
+	registerRcFragments(dir, pkgKey(usePkgDir), subpkg)
+	return useChanged || linksChanged, nil
+}
@@ -1,367 +1,829 @@
 package cmd
 
 import (
-	"bytes"
-	"html/template"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 
-	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"github.com/zetup-sh/zetup/cmd/util"
+	"github.com/zetup-sh/zetup/cmd/facts"
 	"golang.org/x/crypto/ssh"
 	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	ssh2 "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
-	"gopkg.in/yaml.v2"
 )
 
 var pkgViper *viper.Viper
 var pkgToInstall string
+var lockedUse bool
+var onlySubpkgs []string
+var skipSubpkgs []string
 
-type LinuxInfo struct {
-	Distro, Arch, Release, CodeName string
-}
 type ToLink struct {
 	Src, Target string
+	// Mode is how Src is put at Target, one of linkModes
+	Mode string
+	// RawSrc and RawTarget are as written in config.yml, before their
+	// templates are executed
+	RawSrc, RawTarget string
 }
 
-type TplInfo struct {
-	Home     string
-	ZetupDir string
-}
-
-var linuxInfo LinuxInfo
+var sysFacts *facts.Facts
 
 // initCmd represents the init command
 var useCmd = &cobra.Command{
-	Use:   "use",
+	Use:   "use <pkg>",
 	Short: "Specify a zetup package to use",
-	Long:  ``,
+	Long: `Applies a package: the packages it depends on first, then its system
+packages, use script, links and rc fragments, then the same for each of its
+active subpackages.
+
+Hook scripts are found like the use script, post-link.linux, post-link.sh or
+post-link. pre-use runs before the use script, post-link after the files are
+linked and post-use once the package, including its subpackages, is applied.
+"zetup unuse" runs pre-unuse and post-unuse. "zetup update" only runs the
+hooks of a package or subpackage whose use script or links changed.
+
+Scripts and hooks run from their package or subpackage directory with the
+variables of "zetup facts -o shell", plus ZETUP_SUBPKG_DIR, ZETUP_DIR,
+ZETUP_USER_NAME, ZETUP_USER_EMAIL and ZETUP_VAR_<NAME> for each of vars.
+They are run with the interpreter of their #! line, or by their extension.
+
+--only and --skip pick subpackages by name, in the package and in the
+packages it depends on. They are remembered, "zetup update" and the next
+"zetup use" of the same package use them too, until they are given again.
+See "zetup subpkg" for the when conditions of subpackages.`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		pkgToInstall = args[0]
+		if lockedUse {
+			pkgToInstall = lockedPkg(pkgToInstall)
+		}
+		if !dryRun {
+			ensureNoJournal()
+		}
 		ensureRepo()
+		// the selection is kept until it is changed or another package is used
+		undoSelection := JournalEntry{}
+		if cmd.Flags().Changed("only") || cmd.Flags().Changed("skip") || mainViper.GetString("use-pkg") != usePkgDir {
+			undoSelection = selectSubpkgs(onlySubpkgs, skipSubpkgs)
+		}
+		if dryRun {
+			printPlan(buildPlan())
+			return
+		}
+		if lockedUse {
+			ensureLocked()
+		}
 
-		pkgViper = viper.New()
-		pkgViper.AddConfigPath(usePkgDir)
-		pkgViper.SetConfigName("config")
-		if err := pkgViper.ReadInConfig(); err != nil {
-			if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-				log.Println("Your package must contain a config.yml")
-				log.Println("Tip: You can use `zetup generate` to create a skeleton project or `zetup fork` to fork your favorite zetup package.")
-			} else {
-				log.Printf("err = %+v\n", err)
-			}
+		beginJournal(pkgToInstall, usePkgDir)
+		if undoSelection.Action != "" {
+			journalRecord(undoSelection)
+		}
+		runJournaled(usePkg)
+		writeLock()
+	},
+}
+
+// usePkg applies the dependencies of usePkgDir and then usePkgDir, every
+// step is recorded in the journal so it can be rolled back if a later step
+// fails
+func usePkg() error {
+	for _, dep := range useDepends {
+		if mainViper.GetBool("verbose") {
+			log.Printf("using dependency %v\n", pkgKey(dep.Dir()))
+		}
+		if err := withPkg(dep, applyPkg); err != nil {
+			return err
 		}
+	}
+	if err := applyPkg(); err != nil {
+		return err
+	}
 
-		// install linux
-		if runtime.GOOS == "linux" {
-			linuxInfo.Distro = getSystemInfo("lsb_release", "-ds", "distro")
-			linuxInfo.Release = getSystemInfo("lsb_release", "-rs", "release")
-			linuxInfo.CodeName = getSystemInfo("lsb_release", "-cs", "release")
-			linuxInfo.Arch = getSystemInfo("uname", "-m", "architecture")
+	if err := checkInterrupted(); err != nil {
+		return err
+	}
+	recordUsePkg()
+	recordUseDepends()
+	return nil
+}
 
-			if linuxInfo.Distro == "Ubuntu" || linuxInfo.Distro == "Debian" {
-				ensureApt(pkgViper)
-				// apt installs snapd
-				ensureSnap(pkgViper)
-			}
+// applyPkg installs the packages of usePkgDir, runs its use script and links
+// its files, then does the same for its subpackages
+func applyPkg() error {
+	pkgViper = viper.New()
+	pkgViper.AddConfigPath(usePkgDir)
+	pkgViper.SetConfigName("config")
+	if err := pkgViper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			log.Println("Your package must contain a config.yml")
+			log.Println("Tip: You can use `zetup create` to create a skeleton project or `zetup fork` to fork your favorite zetup package.")
+		} else {
+			log.Printf("err = %+v\n", err)
 		}
+	}
 
-		useFile, err := FindFile(usePkgDir, "use", runtime.GOOS, LINUX_EXTENSIONS, mainViper)
-		if err == nil {
-			runFile(useFile)
+	// install linux
+	if runtime.GOOS == "linux" {
+		warnNoPackageManager(pkgViper)
+		if err := ensurePackages(pkgViper, backupScope("")); err != nil {
+			return err
 		}
+	}
+
+	if err := checkInterrupted(); err != nil {
+		return err
+	}
+	if err := runHook(usePkgDir, "", "pre-use", mainViper); err != nil {
+		return err
+	}
+	useFile, err := FindFile(usePkgDir, "use", runtime.GOOS, LINUX_EXTENSIONS, mainViper)
+	if err == nil {
+		if err := runFile(useFile, usePkgDir, ""); err != nil {
+			return err
+		}
+		// the unuse script would undo the package that stays in use when
+		// it was applied before, so only a first use is rolled back with it
+		if !pkgApplied() {
+			journalRecord(JournalEntry{Action: "run-use", Dir: usePkgDir})
+		}
+	}
 
-		LinkFiles(pkgViper, "main-backup.bak")
+	if err := checkInterrupted(); err != nil {
+		return err
+	}
+	if err := LinkFiles(pkgViper, backupScope("")); err != nil {
+		return err
+	}
+	if err := runHook(usePkgDir, "", "post-link", mainViper); err != nil {
+		return err
+	}
+	journalRecordRc()
+	registerRcFragments(usePkgDir, pkgKey(usePkgDir), "")
 
-		useSubpkgs()
+	if err := useSubpkgs(); err != nil {
+		return err
+	}
+	return runHook(usePkgDir, "", "post-use", mainViper)
+}
 
-		mainViper.Set("use-pkg", usePkgDir)
-		mainViper.WriteConfig()
-	},
+// recordUsePkg marks usePkgDir as the package in use
+func recordUsePkg() {
+	journalRecord(JournalEntry{Action: "use-pkg", Args: []string{
+		mainViper.GetString("use-pkg"),
+		mainViper.GetString("use-pkg-source"),
+		mainViper.GetString("use-pkg-ref"),
+		mainViper.GetString("use-pkg-commit"),
+	}})
+	setUsePkg(usePkgDir, usePkgSource.String(), usePkgSource.Ref, headCommit(usePkgDir))
+	mainViper.WriteConfig()
 }
 
-func useSubpkgs() {
-	subpkgDirs := getListOfSubpkgs()
+// pkgApplied is whether usePkgDir was the package in use, or one it depends
+// on, before this run
+func pkgApplied() bool {
+	if mainViper.GetString("use-pkg") == usePkgDir {
+		return true
+	}
+	depends, _ := readUseDepends()
+	for _, dep := range depends {
+		if dep.Dir() == usePkgDir {
+			return true
+		}
+	}
+	return false
+}
+
+// setUsePkg records the active package and the exact commit that was applied
+func setUsePkg(dir string, source string, ref string, commit string) {
+	mainViper.Set("use-pkg", dir)
+	mainViper.Set("use-pkg-source", source)
+	mainViper.Set("use-pkg-ref", ref)
+	mainViper.Set("use-pkg-commit", commit)
+}
+
+// useSubpkgs uses the active subpackages and undoes the ones that were used
+// before but are not active anymore
+func useSubpkgs() error {
+	subpkgDirs, err := getListOfSubpkgs()
+	if err != nil {
+		return err
+	}
 	for _, subpkgDir := range subpkgDirs {
+		if err := checkInterrupted(); err != nil {
+			return err
+		}
 		subpkgViper := viper.New()
 		subpkgViper.AddConfigPath(subpkgDir)
 		subpkgViper.SetConfigName("config")
 		_ = subpkgViper.ReadInConfig()
-		if runtime.GOOS == "linux" {
-			ensureApt(subpkgViper)
-			ensureSnap(subpkgViper)
-			base := path.Base(subpkgDir)
-			useFile, err := FindFile(subpkgDir, "use", runtime.GOOS, LINUX_EXTENSIONS, subpkgViper)
-			if err == nil {
-				runFile(useFile)
+		base := path.Base(subpkgDir)
+		if active, _ := subpkgActive(subpkgDir, subpkgViper); !active {
+			deactivateSubpkg(subpkgDir, subpkgViper)
+			continue
+		}
+		if err := ensurePackages(subpkgViper, backupScope(base)); err != nil {
+			return err
+		}
+		if err := runHook(subpkgDir, base, "pre-use", subpkgViper); err != nil {
+			return err
+		}
+		useFile, err := FindFile(subpkgDir, "use", runtime.GOOS, LINUX_EXTENSIONS, subpkgViper)
+		if err == nil {
+			if err := runFile(useFile, subpkgDir, base); err != nil {
+				return err
+			}
+			if !subpkgApplied(base) {
+				journalRecord(JournalEntry{Action: "run-use", Dir: subpkgDir, Args: []string{base}})
 			}
-			LinkFiles(subpkgViper, base+".sub.bak")
 		}
-
+		if err := LinkFiles(subpkgViper, backupScope(base)); err != nil {
+			return err
+		}
+		if err := runHook(subpkgDir, base, "post-link", subpkgViper); err != nil {
+			return err
+		}
+		journalRecordRc()
+		registerRcFragments(subpkgDir, pkgKey(usePkgDir), base)
+		setSubpkgApplied(base, true)
+		if err := runHook(subpkgDir, base, "post-use", subpkgViper); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func getListOfSubpkgs() []string {
+func getListOfSubpkgs() ([]string, error) {
 	subpkgDir := path.Join(usePkgDir, "subpkg")
 	files, err := ioutil.ReadDir(subpkgDir)
-	check(err)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 	var subpkgDirs []string
 	for _, file := range files {
 		if file.IsDir() {
 			subpkgDirs = append(subpkgDirs, path.Join(subpkgDir, file.Name()))
 		}
 	}
-	return subpkgDirs
+	return subpkgDirs, nil
 }
 
-func LinkFiles(curViper *viper.Viper, bakupName string) {
-	// link files
-	linkFirst, ok := curViper.Get("link").([]interface{})
-	if !ok {
-		return
+// LinkFiles links, copies or renders every link of curViper, whatever was at
+// the targets is backed up in scope
+func LinkFiles(curViper *viper.Viper, scope string) error {
+	toLinkFiles, err := renderLinks(curViper)
+	if err != nil {
+		return err
 	}
-
-	home, _ := homedir.Dir()
-	tplInfo := TplInfo{
-		home,
-		usePkgDir,
+	if len(toLinkFiles) == 0 {
+		return nil
 	}
 
-	// get link files with executed templates
-	var toLinkFiles []ToLink
-	for _, toLink := range linkFirst {
-		toLinkMap := toLink.(map[interface{}]interface{})
-		linkOS := toLinkMap["os"].(string)
-		src := toLinkMap["src"].(string)
-		target := toLinkMap["target"].(string)
-		if src == "" || target == "" {
-			log.Fatal("all links must include a target and a src", toLink)
-		}
-		if linkOS == runtime.GOOS || linkOS == "" {
-			targetTmpl, err := template.New("target").Parse(target)
-			if err != nil {
-				log.Println("There was a problem with ", target)
-				panic(err)
-			}
-
-			srcTmpl, err := template.New("src").Parse(src)
+	// render templates up front so a broken one fails before anything changes
+	tplInfo := newTplInfo(curViper)
+	rendered := map[string]string{}
+	for _, toLinkFile := range toLinkFiles {
+		if toLinkFile.Mode == "template" {
+			contents, err := renderTemplateFile(toLinkFile.Src, tplInfo)
 			if err != nil {
-				log.Println("There was a problem with ", src)
-				panic(err)
-			}
-
-			var targetTpl bytes.Buffer
-			if err := targetTmpl.Execute(&targetTpl, tplInfo); err != nil {
-				log.Println("There was a problem with ", target)
-				log.Fatal(err)
+				return err
 			}
-			finalTarget := targetTpl.String()
+			rendered[toLinkFile.Target] = contents
+		}
+	}
 
-			var srcTpl bytes.Buffer
-			if err := srcTmpl.Execute(&srcTpl, tplInfo); err != nil {
-				log.Println("There was a problem with ", src)
-				log.Fatal(err)
-			}
-			finalSrc := srcTpl.String()
-			newToLink := ToLink{
-				Src:    string(finalSrc),
-				Target: string(finalTarget),
-			}
-			toLinkFiles = append(toLinkFiles, newToLink)
+	// nothing to do if every link is in place and no template output changed
+	inPlace := true
+	for _, toLinkFile := range toLinkFiles {
+		if !linkInPlace(toLinkFile, rendered[toLinkFile.Target]) {
+			inPlace = false
 		}
 	}
+	if inPlace {
+		return nil
+	}
+
+	// a rollback puts back what is there now, which can be links of an
+	// earlier `zetup use` of the same package
+	snapshot, err := snapshotLinks(scope, toLinkFiles)
+	if err != nil {
+		return err
+	}
+	var targets []string
+	for _, toLinkFile := range toLinkFiles {
+		targets = append(targets, toLinkFile.Target)
+	}
+	journalRecord(JournalEntry{Action: "link", Scope: scope, Args: targets, Snapshot: &snapshot})
 
-	// first restore backup files before overwriting them again
-	RestoreBackupFiles()
+	// first restore this scope's backups before overwriting them again
+	if err := restoreBackupScope(scope); err != nil {
+		return err
+	}
 
-	// back files up first
+	// back files up first, links already in place are zetup's own
 	var backedupFiles []BackupFileInfo
 	for _, toLinkFile := range toLinkFiles {
-		// back up all files to one single map
-		if util.Exists(toLinkFile.Target) {
-			// back up target
-			dat, err := ioutil.ReadFile(toLinkFile.Target)
-			check(err)
-			backupFileInfo := BackupFileInfo{
-				toLinkFile.Target,
-				string(dat),
+		if linkInPlace(toLinkFile, rendered[toLinkFile.Target]) {
+			continue
+		}
+		if _, err := os.Lstat(toLinkFile.Target); err == nil {
+			entries, err := backupLocation(toLinkFile.Target)
+			if err != nil {
+				return err
 			}
-			backedupFiles = append(backedupFiles, backupFileInfo)
+			backedupFiles = append(backedupFiles, entries...)
 		}
 	}
-	marshaled, err := yaml.Marshal(backedupFiles)
-	check(err)
-
-	backupFile := path.Join(bakDir, bakupName)
-	backupWithHeader := []byte("# generated file do not edit\n" + string(marshaled))
-	err = ioutil.
-		WriteFile(backupFile, backupWithHeader, 0644)
-	check(err)
+	err = saveBackup(scope, backedupFiles)
+	if err != nil {
+		return err
+	}
 
 	// then link the actual files
 	// we back up first in case something goes wrong
 	for _, toLinkFile := range toLinkFiles {
-		err := os.Remove(toLinkFile.Target)
-		err = os.Symlink(toLinkFile.Src, toLinkFile.Target)
-		check(err)
+		// directories were backed up with everything in them
+		os.RemoveAll(toLinkFile.Target)
+		if err := placeLink(toLinkFile, rendered[toLinkFile.Target]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkModes are the ways a link can be put in place, symlink is the default
+// unless the package sets link-mode
+var linkModes = []string{"symlink", "relative", "copy", "hardlink", "template"}
+
+// placeLink puts src at target according to its mode, rendered is the
+// output of a template
+func placeLink(toLinkFile ToLink, rendered string) error {
+	switch toLinkFile.Mode {
+	case "template":
+		return writeTemplateOutput(toLinkFile, rendered)
+	case "relative":
+		return os.Symlink(relativeLinkDest(toLinkFile), toLinkFile.Target)
+	case "copy":
+		return copyFile(toLinkFile.Src, toLinkFile.Target)
+	case "hardlink":
+		return os.Link(toLinkFile.Src, toLinkFile.Target)
+	}
+	return os.Symlink(toLinkFile.Src, toLinkFile.Target)
+}
+
+// relative links keep working when $ZETUP_DIR and home are moved together
+func relativeLinkDest(toLinkFile ToLink) string {
+	rel, err := filepath.Rel(filepath.Dir(toLinkFile.Target), toLinkFile.Src)
+	if err != nil {
+		return toLinkFile.Src
+	}
+	return rel
+}
+
+func copyFile(src string, target string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("can not copy directory %v, use mode symlink or relative", src)
+	}
+	dat, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target, dat, info.Mode().Perm())
+}
+
+// templates are written with the permissions of their source, so an ssh
+// config template can be 0600
+func writeTemplateOutput(toLinkFile ToLink, contents string) error {
+	info, err := os.Stat(toLinkFile.Src)
+	if err != nil {
+		return err
 	}
+	return ioutil.WriteFile(toLinkFile.Target, []byte(contents), info.Mode().Perm())
 }
 
-func getSystemInfo(bashcmd string, flags string, name string) string {
-	out, err := exec.Command(bashcmd, flags).Output()
+// linkInPlace is true if target already is what placeLink would make of
+// it, rendered is the output of a template
+func linkInPlace(toLinkFile ToLink, rendered string) bool {
+	info, err := os.Lstat(toLinkFile.Target)
 	if err != nil {
-		os.Stderr.WriteString("Could not read " + name + " from " + bashcmd)
+		return false
+	}
+	switch toLinkFile.Mode {
+	case "template", "copy":
+		if !info.Mode().IsRegular() {
+			return false
+		}
+		if toLinkFile.Mode == "copy" {
+			dat, err := ioutil.ReadFile(toLinkFile.Src)
+			if err != nil {
+				return false
+			}
+			rendered = string(dat)
+		}
+		dat, err := ioutil.ReadFile(toLinkFile.Target)
+		return err == nil && string(dat) == rendered
+	case "hardlink":
+		srcInfo, err := os.Stat(toLinkFile.Src)
+		return err == nil && os.SameFile(srcInfo, info)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	dest, err := os.Readlink(toLinkFile.Target)
+	if toLinkFile.Mode == "relative" {
+		return err == nil && dest == relativeLinkDest(toLinkFile)
+	}
+	return err == nil && dest == toLinkFile.Src
+}
+
+func isLinkMode(mode string) bool {
+	for _, linkMode := range linkModes {
+		if mode == linkMode {
+			return true
+		}
+	}
+	return false
+}
+
+// renderLinks executes the src and target templates of every link and
+// template for this os, entries in `template` get mode template
+func renderLinks(curViper *viper.Viper) ([]ToLink, error) {
+	links, _ := curViper.Get("link").([]interface{})
+	templates, _ := curViper.Get("template").([]interface{})
+	if len(links) == 0 && len(templates) == 0 {
+		return nil, nil
+	}
+	tplInfo := newTplInfo(curViper)
+
+	// link-mode in the subpackage, then the package, then symlink
+	defaultMode := curViper.GetString("link-mode")
+	if defaultMode == "" {
+		defaultMode = readPkgViper(usePkgDir).GetString("link-mode")
+	}
+	if defaultMode == "" {
+		defaultMode = "symlink"
+	}
+
+	// get link files with executed templates
+	var toLinkFiles []ToLink
+	for i, toLink := range append(append([]interface{}{}, links...), templates...) {
+		toLinkMap, _ := toLink.(map[interface{}]interface{})
+		linkOS, _ := toLinkMap["os"].(string)
+		src, _ := toLinkMap["src"].(string)
+		target, _ := toLinkMap["target"].(string)
+		mode, _ := toLinkMap["mode"].(string)
+		if mode == "" {
+			mode = defaultMode
+		}
+		if i >= len(links) {
+			mode = "template"
+		}
+		if src == "" || target == "" {
+			return nil, fmt.Errorf("all links must include a target and a src %v", toLink)
+		}
+		if !isLinkMode(mode) {
+			return nil, fmt.Errorf("unknown link mode %v for %v, use one of %v", mode, target, strings.Join(linkModes, ", "))
+		}
+		if linkOS == runtime.GOOS || linkOS == "" {
+			finalTarget, err := renderTemplate(target, target, tplInfo)
+			if err != nil {
+				return nil, err
+			}
+			finalSrc, err := renderTemplate(src, src, tplInfo)
+			if err != nil {
+				return nil, err
+			}
+			toLinkFiles = append(toLinkFiles, ToLink{
+				Src:       finalSrc,
+				Target:    finalTarget,
+				Mode:      mode,
+				RawSrc:    src,
+				RawTarget: target,
+			})
+		}
+	}
+	return toLinkFiles, nil
+}
+
+// getFacts detects the machine facts once, --facts-file overrides them
+func getFacts() facts.Facts {
+	if sysFacts == nil {
+		f, err := facts.Gather(factsFile)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("could not read %v: %v", factsFile, err)
 		}
+		sysFacts = &f
 	}
-	return string(out)
+	return *sysFacts
 }
 
 func init() {
 	rootCmd.AddCommand(useCmd)
+	useCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false,
+		"print what would be done without doing it")
+	useCmd.Flags().StringVarP(&outputFormat, "output", "o", "text",
+		"output format for --dry-run, text or json")
+	useCmd.Flags().BoolVarP(&lockedUse, "locked", "", false,
+		"refuse to use the package if it resolves differently from $ZETUP_DIR/zetup.lock,\n"+
+			"without a @ref the locked commit is checked out")
+	useCmd.Flags().StringSliceVarP(&onlySubpkgs, "only", "", nil,
+		"only use these subpackages, like --only gui,work")
+	useCmd.Flags().StringSliceVarP(&skipSubpkgs, "skip", "", nil,
+		"don't use these subpackages")
 }
 
 var usePkgDir string
+var usePkgSource PkgSource
 var usePkgDirParent string
 
-func ensureSnap(vip *viper.Viper) {
-	// check if there are any apt packages not already installed
-	snapPackages := vip.GetStringSlice("snap")
-	if len(snapPackages) == 0 {
-		return
+func ensureRepo() {
+	source, err := parsePkgSource(pkgToInstall)
+	if err != nil {
+		log.Fatal(err)
 	}
+	usePkgSource = source
 
-	snapPackagesAlreadyInstalled := mainViper.GetStringMap("installed-snap")
-	for _, pkg := range snapPackages {
-		if snapPackagesAlreadyInstalled[pkg] == nil {
-			if mainViper.GetBool("verbose") {
-				log.Printf("installing %+v using snap\n", pkg)
-			}
-			cmdArgs := append([]string{"snap", "install", "--classic"}, pkg)
-			runCmd := exec.Command("sudo", cmdArgs...)
-			runCmd.Stdout = os.Stdout
-			runCmd.Stdin = os.Stdin
-			runCmd.Stderr = os.Stderr
-			err = runCmd.Run()
-			if err != nil {
-				log.Println("Could not run snap install")
-				log.Fatal(err)
-			}
-			if mainViper.GetBool("verbose") {
-				log.Println("successfully installed snap", pkg)
-			}
-			mainViper.Set("installed-snap."+pkg, true)
-			mainViper.WriteConfig()
+	usePkgDir = source.Dir()
+	usePkgDirParent, _ = path.Split(usePkgDir)
+	if err := cloneSource(source); err != nil {
+		log.Fatal(err)
+	}
+
+	useDepends, err = resolveDepends(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// cloneSource clones source into source.Dir() unless it is there already and
+// checks out source.Ref, or the default branch without a ref. With --dry-run
+// an existing clone is left as it is.
+func cloneSource(source PkgSource) error {
+	dir := source.Dir()
+	parent, _ := path.Split(dir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	cloned := false
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		cloned = true
+		if mainViper.GetBool("verbose") {
+			log.Println(pkgKey(dir) + " not found, cloning " + source.URL + "...")
+		}
+
+		auth, err := source.Auth()
+		if err != nil {
+			return err
 		}
+		r, err := git.PlainClone(dir, false, &git.CloneOptions{
+			URL:               source.URL,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Auth:              auth,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = r.Head()
+		if err != nil {
+			return err
+		}
+	}
+
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
 	}
+	if dryRun && !cloned {
+		return previewCheckout(r, source)
+	}
+	if source.Ref == "" {
+		return checkoutDefaultBranch(r, source)
+	}
+	hash, kind, err := checkoutRef(r, source)
+	if err != nil {
+		return fmt.Errorf("could not check out %v: %v", source.Ref, err)
+	}
+	if mainViper.GetBool("verbose") {
+		log.Printf("checked out %v %v (%v)\n", kind, source.Ref, hash)
+	}
+	return nil
 }
 
-func ensureApt(vip *viper.Viper) {
-	// check if there are any apt packages not already installed
-	aptPackages := vip.GetStringSlice("apt")
+// checkoutDefaultBranch puts a clone that an earlier `zetup use pkg@ref` left
+// at the ref back on its default branch
+func checkoutDefaultBranch(r *git.Repository, source PkgSource) error {
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	if head.Name().IsBranch() {
+		return nil
+	}
+	branch, err := defaultBranch(r)
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	err = w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch)})
+	if err != nil {
+		return fmt.Errorf("could not check out %v: %v", branch, err)
+	}
+	if mainViper.GetBool("verbose") {
+		log.Printf("checked out branch %v\n", branch)
+	}
+	return updateSubmodules(w, source)
+}
 
-	aptPackagesAlreadyInstalled := mainViper.GetStringMap("installed-apt")
-	var toInstall []string
-	for _, pkg := range aptPackages {
-		if aptPackagesAlreadyInstalled[pkg] == nil {
-			toInstall = append(toInstall, pkg)
+// defaultBranch is the branch origin/HEAD points to, or else the branch the
+// clone was made with
+func defaultBranch(r *git.Repository) (string, error) {
+	originHead, err := r.Reference(plumbing.NewRemoteHEADReferenceName("origin"), false)
+	if err == nil && originHead.Type() == plumbing.SymbolicReference {
+		return strings.TrimPrefix(originHead.Target().String(), "refs/remotes/origin/"), nil
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return "", err
+	}
+	var branches []string
+	for name, branch := range cfg.Branches {
+		if branch.Remote == "origin" {
+			branches = append(branches, name)
 		}
 	}
+	if len(branches) == 0 {
+		return "", errors.New("could not find the default branch")
+	}
+	sort.Strings(branches)
+	return branches[0], nil
+}
 
-	if len(toInstall) > 0 {
-		if mainViper.GetBool("verbose") {
-			log.Printf("updating apt\n")
+// previewCheckout says what cloneSource would check out without touching the
+// clone, the plan is made from what is checked out now
+func previewCheckout(r *git.Repository, source PkgSource) error {
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	want := source.Ref
+	var hash plumbing.Hash
+	if source.Ref == "" {
+		if head.Name().IsBranch() {
+			return nil
 		}
-		runCmd := exec.Command("sudo", "apt-get", "update", "-yqq")
-		runCmd.Stdout = os.Stdout
-		runCmd.Stdin = os.Stdin
-		runCmd.Stderr = os.Stderr
-		err := runCmd.Run()
+		want, err = defaultBranch(r)
 		if err != nil {
-			log.Println("Could not run apt-get update")
-			log.Fatal(err)
+			return err
 		}
-
-		if mainViper.GetBool("verbose") {
-			log.Printf("installing %+v using apt\n", toInstall)
-		}
-		cmdArgs := append([]string{"apt-get", "install", "-yqq"}, toInstall...)
-		runCmd = exec.Command("sudo", cmdArgs...)
-		runCmd.Stdout = os.Stdout
-		runCmd.Stdin = os.Stdin
-		runCmd.Stderr = os.Stderr
-		err = runCmd.Run()
+		ref, err := r.Reference(plumbing.NewBranchReferenceName(want), true)
 		if err != nil {
-			log.Println("Could not run apt-get install")
-			log.Fatal(err)
+			return err
 		}
-		for _, pkg := range toInstall {
-			mainViper.Set("installed-apt."+pkg, true)
+		hash = ref.Hash()
+	} else {
+		hash, _, err = resolveRef(r, source.Ref)
+		if err != nil {
+			log.Printf("%v would fetch and check out %v, the plan is for %.7v which is checked out now\n",
+				pkgKey(source.Dir()), source.Ref, head.Hash().String())
+			return nil
 		}
-		mainViper.WriteConfig()
 	}
+	if hash != head.Hash() {
+		log.Printf("%v would check out %v (%.7v), the plan is for %.7v which is checked out now\n",
+			pkgKey(source.Dir()), want, hash.String(), head.Hash().String())
+	}
+	return nil
 }
 
-func ensureRepo() {
-	splitPath := strings.Split(pkgToInstall, "/")
-	if len(splitPath) == 1 {
-		splitPath = []string{"github.com", mainViper.GetString("github-username"), splitPath[0]}
+// checkoutRef fetches and checks out source.Ref in a detached HEAD, the ref
+// can be a tag, a branch on origin or a (short) commit hash
+func checkoutRef(r *git.Repository, source PkgSource) (plumbing.Hash, string, error) {
+	auth, err := source.Auth()
+	if err != nil {
+		return plumbing.ZeroHash, "", err
 	}
-	if len(splitPath) != 3 || splitPath[0] != "github.com" {
-		log.Fatal("Only github is supported for now.")
+	err = r.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		Tags:       git.AllTags,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, "", err
 	}
 
-	usePkgDir = pkgDir + string(os.PathSeparator) + path.Join(splitPath...)
-	usePkgDirParent, _ = path.Split(usePkgDir)
-	err := os.MkdirAll(usePkgDirParent, 0755)
+	hash, kind, err := resolveRef(r, source.Ref)
 	if err != nil {
-		log.Fatal(err)
+		return plumbing.ZeroHash, "", err
 	}
 
-	if _, err := os.Stat(usePkgDir); os.IsNotExist(err) {
-		if mainViper.GetBool("verbose") {
-			log.Println(path.Join(splitPath...) + " not found, cloning...")
-		}
-
-		var url string
-		username := splitPath[1]
-		githubUsername := mainViper.GetString("github-username")
-		log.Println("username", username)
-		var r *git.Repository
-		if githubUsername != username {
-			url = "https://github.com/" + username + "/" + splitPath[2] + ".git"
-			r, err = git.PlainClone(usePkgDir, false, &git.CloneOptions{
-				URL:               url,
-				RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-			})
-		} else {
-			privateKeyFile := mainViper.GetString("private-key-file")
-
-			pem, _ := ioutil.ReadFile(privateKeyFile)
-			signer, _ := ssh.ParsePrivateKey(pem)
-			auth := &ssh2.PublicKeys{User: "git", Signer: signer}
-			url = "git@github.com:" + username + "/" + splitPath[2] + ".git"
-			r, err = git.PlainClone(usePkgDir, false, &git.CloneOptions{
-				URL:               url,
-				RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-				Auth:              auth,
-			})
-		}
+	w, err := r.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, "", err
+	}
+	err = w.Checkout(&git.CheckoutOptions{Hash: hash})
+	if err != nil {
+		return plumbing.ZeroHash, "", err
+	}
+	if err := updateSubmodules(w, source); err != nil {
+		return plumbing.ZeroHash, "", err
+	}
+	return hash, kind, nil
+}
 
+// updateSubmodules checks out the submodules of what w has checked out
+func updateSubmodules(w *git.Worktree, source PkgSource) error {
+	auth, err := source.Auth()
+	if err != nil {
+		return err
+	}
+	submodules, err := w.Submodules()
+	if err != nil {
+		return err
+	}
+	return submodules.Update(&git.SubmoduleUpdateOptions{
+		Init:              true,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+		Auth:              auth,
+	})
+}
+
+// resolveRef returns the commit for ref and whether it is a tag, branch or commit
+func resolveRef(r *git.Repository, ref string) (plumbing.Hash, string, error) {
+	if hash, err := r.ResolveRevision(plumbing.Revision("refs/tags/" + ref)); err == nil {
+		return *hash, "tag", nil
+	}
+	if hash, err := r.ResolveRevision(plumbing.Revision("refs/remotes/origin/" + ref)); err == nil {
+		return *hash, "branch", nil
+	}
+	if hash, err := r.ResolveRevision(plumbing.Revision(ref)); err == nil {
+		return *hash, "commit", nil
+	}
+
+	// short commit hashes
+	if len(ref) >= 4 && len(ref) < 40 && strings.Trim(strings.ToLower(ref), "0123456789abcdef") == "" {
+		var found []plumbing.Hash
+		commits, err := r.CommitObjects()
 		if err != nil {
-			log.Fatal(err)
+			return plumbing.ZeroHash, "", err
 		}
-		_, err = r.Head()
+		err = commits.ForEach(func(c *object.Commit) error {
+			if strings.HasPrefix(c.Hash.String(), strings.ToLower(ref)) {
+				found = append(found, c.Hash)
+			}
+			return nil
+		})
 		if err != nil {
-			log.Fatal(err)
+			return plumbing.ZeroHash, "", err
+		}
+		if len(found) == 1 {
+			return found[0], "commit", nil
 		}
+		if len(found) > 1 {
+			return plumbing.ZeroHash, "", fmt.Errorf("%v is ambiguous", ref)
+		}
+	}
+	return plumbing.ZeroHash, "", fmt.Errorf("no tag, branch or commit named %v", ref)
+}
+
+// headCommit is the commit currently checked out in dir
+func headCommit(dir string) string {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return ""
+	}
+	head, err := r.Head()
+	if err != nil {
+		return ""
 	}
+	return head.Hash().String()
+}
+
+// githubSSHAuth uses the ssh key zetup added to github
+func githubSSHAuth() *ssh2.PublicKeys {
+	privateKeyFile := mainViper.GetString("private-key-file")
+
+	pem, _ := ioutil.ReadFile(privateKeyFile)
+	signer, _ := ssh.ParsePrivateKey(pem)
+	return &ssh2.PublicKeys{User: "git", Signer: signer}
 }